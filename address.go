@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Postal address from the address book of a member. The same fields are
+// copied onto orders, so later changes don't alter past orders.
+type Address struct {
+	Id      int64  `json:"id"`
+	Member  int64  `json:"member"`
+	Name    string `json:"name"`  // Recipient
+	Extra   string `json:"extra"` // Optional, e.g. company or c/o
+	Street  string `json:"street"`
+	Zip     string `json:"zip"`
+	City    string `json:"city"`
+	Country string `json:"country"` // Optional, empty for Germany
+}
+
+// Longest value accepted for any address field
+const MaxAddressFieldLength = 100
+
+func AddressFromRow(rows *sql.Rows) (Address, error) {
+	var addr Address
+
+	err := rows.Scan(&addr.Id, &addr.Member, &addr.Name, &addr.Extra, &addr.Street, &addr.Zip, &addr.City, &addr.Country)
+	return addr, err
+}
+
+// Address as printed on a parcel, one line per element.
+func (addr Address) Lines() []string {
+	lines := []string{addr.Name}
+	if addr.Extra != "" {
+		lines = append(lines, addr.Extra)
+	}
+	lines = append(lines, addr.Street, addr.Zip+" "+addr.City)
+	if addr.Country != "" {
+		lines = append(lines, addr.Country)
+	}
+
+	return lines
+}
+
+// Fields of the form are "name", "extra", "street", "zip", "city" and
+// "country", each preceded by prefix.
+func AddressFromForm(form url.Values, prefix string) Address {
+	return Address{
+		Name:    strings.TrimSpace(form.Get(prefix + "name")),
+		Extra:   strings.TrimSpace(form.Get(prefix + "extra")),
+		Street:  strings.TrimSpace(form.Get(prefix + "street")),
+		Zip:     strings.TrimSpace(form.Get(prefix + "zip")),
+		City:    strings.TrimSpace(form.Get(prefix + "city")),
+		Country: strings.TrimSpace(form.Get(prefix + "country")),
+	}
+}
+
+func (addr Address) Empty() bool {
+	return addr.Name == "" && addr.Extra == "" && addr.Street == "" && addr.Zip == "" && addr.City == "" && addr.Country == ""
+}
+
+func CheckAddress(addr Address) error {
+	if addr.Name == "" || addr.Street == "" || addr.Zip == "" || addr.City == "" {
+		return NewStatusError(400, "Address needs name, street, zip code and city")
+	}
+
+	for _, f := range []string{addr.Name, addr.Extra, addr.Street, addr.Zip, addr.City, addr.Country} {
+		if utf8.RuneCountInString(f) > MaxAddressFieldLength {
+			return NewStatusError(400, "Address fields must be %d characters or shorter", MaxAddressFieldLength)
+		}
+	}
+
+	return nil
+}
+
+// Adds the address to the address book of its member.
+func InsertAddress(addr Address, database *sql.DB) (Address, error) {
+	err := CheckAddress(addr)
+	if err != nil {
+		return Address{}, err
+	}
+
+	res, err := database.Exec("INSERT INTO addresses VALUES ( NULL, ?, ?, ?, ?, ?, ?, ? )", addr.Member, addr.Name, addr.Extra, addr.Street, addr.Zip, addr.City, addr.Country)
+	if err != nil {
+		return Address{}, err
+	}
+
+	addr.Id, err = res.LastInsertId()
+	return addr, err
+}
+
+func FetchAddress(id int64, database *sql.DB) (Address, error) {
+	rows, err := database.Query("SELECT * FROM addresses WHERE id = ?", id)
+	if err != nil {
+		return Address{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return Address{}, errors.New("No such address")
+	}
+
+	addr, err := AddressFromRow(rows)
+	rows.Close()
+
+	return addr, err
+}
+
+// Address book of the member.
+func FetchAddresses(memId int64, database *sql.DB) ([]Address, error) {
+	rows, err := database.Query("SELECT * FROM addresses WHERE member = ? ORDER BY id", memId)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]Address, 0)
+	for rows.Next() {
+		addr, err := AddressFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	rows.Close()
+
+	return addrs, nil
+}
+
+// Address from the address book of the member, 404 if it belongs to someone
+// else.
+func FetchMemberAddress(id int64, mem Member, database *sql.DB) (Address, error) {
+	addr, err := FetchAddress(id, database)
+	if err != nil || addr.Member != mem.Id || mem.Id == 0 {
+		return Address{}, NewStatusError(404, "Address %d not found", id)
+	}
+
+	return addr, nil
+}
+
+func RemoveAddress(addr Address, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM addresses WHERE id = ?", addr.Id)
+	return err
+}
+
+// Copies the address onto the order. Kind is "shipping" or "billing".
+func SaveOrderAddress(ordId int64, kind string, addr Address, tx *sql.Tx) error {
+	_, err := tx.Exec("INSERT INTO order_addresses VALUES ( ?, ?, ?, ?, ?, ?, ?, ? )", ordId, kind, addr.Name, addr.Extra, addr.Street, addr.Zip, addr.City, addr.Country)
+	return err
+}
+
+// Shipping and billing address of the order, nil if it has none. Orders
+// without a separate billing address are billed to the shipping address.
+func FetchOrderAddresses(ordId int64, database *sql.DB) (*Address, *Address, error) {
+	rows, err := database.Query("SELECT kind,name,extra,street,zip,city,country FROM order_addresses WHERE orderid = ?", ordId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ship, bill *Address
+	for rows.Next() {
+		var kind string
+		var addr Address
+
+		err = rows.Scan(&kind, &addr.Name, &addr.Extra, &addr.Street, &addr.Zip, &addr.City, &addr.Country)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+
+		if kind == "billing" {
+			bill = &addr
+		} else {
+			ship = &addr
+		}
+	}
+	rows.Close()
+
+	if bill == nil {
+		bill = ship
+	}
+	return ship, bill, nil
+}
+
+func GetAddresses(mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	addrs, err := FetchAddresses(mem.Id, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch addresses: "+err.Error(), 500)
+		return
+	}
+
+	RenderTemplate(w, r, "addresses/list", "", mem, addrs)
+}
+
+func PostNewAddress(mem Member, w http.ResponseWriter, r *http.Request) {
+	addr := AddressFromForm(r.PostForm, "")
+	addr.Member = mem.Id
+
+	DatabaseMutex.Lock()
+	_, err := InsertAddress(addr, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to save address: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/addresses/", 301)
+}
+
+// Removes the address from the address book. Orders keep their copy.
+func DeleteAddress(addr Address, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	err := RemoveAddress(addr, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to delete address: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/addresses/", 301)
+}
+
+func HandleAddress(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleAddress() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if mem.Id == 0 {
+		http.Redirect(w, r, "/pages/login", 301)
+		return
+	}
+
+	meth := r.Method
+	if r.Method == "POST" {
+		err := r.ParseForm()
+
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		meths, ok := r.PostForm["_method"]
+		if ok && len(meths) == 1 && len(meths[0]) > 0 {
+			meth = meths[0]
+		}
+	}
+
+	if r.URL.Path == "/addresses" || r.URL.Path == "/addresses/" {
+		if meth == "GET" {
+			GetAddresses(mem, w, r)
+		} else if meth == "POST" {
+			PostNewAddress(mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		addrId, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/addresses/"), 10, 64)
+
+		if err != nil {
+			http.Error(w, "Address not found: "+err.Error(), 404)
+			return
+		}
+
+		DatabaseMutex.Lock()
+		addr, err := FetchMemberAddress(addrId, mem, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Address not found", 404)
+			return
+		}
+
+		if meth == "DELETE" {
+			DeleteAddress(addr, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	}
+}
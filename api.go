@@ -0,0 +1,960 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// JSON API under /api/v1/. It uses the same session cookie as the HTML pages,
+// requests other than GET need the CSRF token of the session in the
+// X-CSRF-Token header. It is returned by GET /api/v1/session.
+//
+//   GET    /api/v1/session
+//   GET    /api/v1/categories
+//   GET    /api/v1/products           POST /api/v1/products
+//   GET    /api/v1/products/<id>      PUT, DELETE /api/v1/products/<id>
+//   POST   /api/v1/variants
+//   GET    /api/v1/variants/<id>      PUT, DELETE /api/v1/variants/<id>
+//   GET    /api/v1/cart               POST /api/v1/cart
+//   PUT    /api/v1/cart/<product>     DELETE /api/v1/cart/<product>?variant=<id>
+//   GET    /api/v1/orders             POST /api/v1/orders
+//   GET    /api/v1/orders/my
+//   GET    /api/v1/orders/<id>        PUT, DELETE /api/v1/orders/<id>
+//   GET    /api/v1/members            POST /api/v1/members
+//   GET    /api/v1/members/me
+//   GET    /api/v1/members/<id>       PUT, DELETE /api/v1/members/<id>
+//   GET    /api/v1/addresses          POST /api/v1/addresses
+//   DELETE /api/v1/addresses/<id>
+//   GET    /api/v1/coupons            POST /api/v1/coupons
+//   GET    /api/v1/coupons/<id>       PUT, DELETE /api/v1/coupons/<id>
+//
+// PUT replaces the resource with the body, except that products and variants
+// keep the group prices the body leaves out.
+//
+// Errors are reported as {"error": {"status": 404, "message": "..."}}.
+
+const APIPrefix = "/api/v1/"
+
+// Largest request body accepted by the API
+const MaxAPIBodySize int64 = 1 << 20
+
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func IsAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, APIPrefix)
+}
+
+func WriteJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func WriteAPIError(w http.ResponseWriter, code int, msg string) {
+	WriteJSON(w, code, struct {
+		Error APIError `json:"error"`
+	}{
+		APIError{code, msg},
+	})
+}
+
+// Reports err with the status code of a StatusError or 500.
+func WriteAPIErr(w http.ResponseWriter, err error) {
+	WriteAPIError(w, ErrorStatus(err), err.Error())
+}
+
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxAPIBodySize))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil {
+		return NewStatusError(400, "Invalid JSON body: %s", err.Error())
+	}
+	return nil
+}
+
+// Like DecodeJSON, but an empty body leaves v untouched.
+func DecodeOptionalJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxAPIBodySize))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return NewStatusError(400, "Invalid JSON body: %s", err.Error())
+	}
+	return nil
+}
+
+// Splits the path below /api/v1/<resource>/ into the resource and the
+// optional id part.
+func APIPath(r *http.Request) (string, string) {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "/", 2)
+
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func APIParseId(id string) (int64, error) {
+	ret, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, NewStatusError(404, "Not found")
+	}
+	return ret, nil
+}
+
+func APIRequireMember(mem Member) error {
+	if mem.Id == 0 {
+		return NewStatusError(401, "Please login first")
+	}
+	return nil
+}
+
+func APIGetSession(sess Session, mem Member, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteAPIError(w, 405, "Method not supported")
+		return
+	}
+
+	WriteJSON(w, 200, struct {
+		Member Member `json:"member"`
+		CSRF   string `json:"csrf"`
+	}{
+		mem,
+		sess.CSRF,
+	})
+}
+
+func APICategories(mem Member, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteAPIError(w, 405, "Method not supported")
+		return
+	}
+
+	DatabaseMutex.Lock()
+	cats, err := FetchCategories(Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	WriteJSON(w, 200, cats)
+}
+
+// Product as changed by the body of a PUT request. Group prices left out of
+// the body are kept. Images are uploaded through the product page and
+// variants changed under /variants/, the body may only repeat them.
+func apiUpdatedProduct(stored Product, body Product) (Product, error) {
+	body.Id = stored.Id
+
+	if body.GroupPrices == nil {
+		body.GroupPrices = stored.GroupPrices
+	}
+
+	if body.Images != nil && strings.Join(body.Images, "/") != strings.Join(stored.Images, "/") {
+		return Product{}, NewStatusError(400, "Images can't be changed through the API")
+	}
+	body.Images = stored.Images
+	body.Variants = stored.Variants
+
+	return body, nil
+}
+
+func APIProducts(id string, mem Member, w http.ResponseWriter, r *http.Request) {
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			DatabaseMutex.Lock()
+			defer DatabaseMutex.Unlock()
+
+			rows, err := Database.Query("SELECT * FROM products")
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			prods := make([]Product, 0)
+			for rows.Next() {
+				prod, err := ProductFromRow(rows)
+				if err != nil {
+					rows.Close()
+					WriteAPIErr(w, err)
+					return
+				}
+				prods = append(prods, prod)
+			}
+			rows.Close()
+
+			for i := range prods {
+				prods[i], err = FetchProductDetails(prods[i], Database)
+				if err != nil {
+					WriteAPIErr(w, err)
+					return
+				}
+			}
+
+			WriteJSON(w, 200, prods)
+
+		case "POST":
+			var prod Product
+
+			err := RequirePermission(mem, "products.edit")
+			if err == nil {
+				err = DecodeJSON(w, r, &prod)
+			}
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			prod.Id = 0
+
+			DatabaseMutex.Lock()
+			defer DatabaseMutex.Unlock()
+
+			err = CheckProduct(prod, Database)
+			if err == nil {
+				prod, err = InsertProduct(prod, Database)
+			}
+			if err == nil {
+				prod, err = FetchProduct(prod.Id, Database)
+			}
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			w.Header().Set("Location", GlobalConfig.Location+APIPrefix+"products/"+strconv.FormatInt(prod.Id, 10))
+			WriteJSON(w, 201, prod)
+
+		default:
+			WriteAPIError(w, 405, "Method not supported")
+		}
+		return
+	}
+
+	prodId, err := APIParseId(id)
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	prod, err := FetchProduct(prodId, Database)
+	if err != nil {
+		WriteAPIError(w, 404, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, 200, prod)
+
+	case "PUT":
+		var new_prod Product
+
+		err := RequirePermission(mem, "products.edit")
+		if err == nil {
+			err = DecodeJSON(w, r, &new_prod)
+		}
+		if err == nil {
+			new_prod, err = apiUpdatedProduct(prod, new_prod)
+		}
+		if err == nil {
+			err = CheckProduct(new_prod, Database)
+		}
+		if err == nil {
+			_, err = UpdateProduct(new_prod, Database)
+		}
+		if err == nil {
+			prod, err = FetchProduct(prod.Id, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, prod)
+
+	case "DELETE":
+		err := RequirePermission(mem, "products.edit")
+		if err == nil {
+			err = RemoveProduct(prod, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 204, nil)
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+	}
+}
+
+// Variants of a product are listed with the product, new ones name their
+// product in the body.
+func APIVariants(id string, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	if id == "" {
+		if r.Method != "POST" {
+			WriteAPIError(w, 405, "Method not supported")
+			return
+		}
+
+		var v Variant
+		err := RequirePermission(mem, "products.edit")
+		if err == nil {
+			err = DecodeJSON(w, r, &v)
+		}
+		if err == nil {
+			v.Id = 0
+			err = CheckVariant(v, Database)
+		}
+		if err == nil {
+			v, err = InsertVariant(v, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		w.Header().Set("Location", GlobalConfig.Location+APIPrefix+"variants/"+strconv.FormatInt(v.Id, 10))
+		WriteJSON(w, 201, v)
+		return
+	}
+
+	varId, err := APIParseId(id)
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	v, err := FetchVariant(varId, Database)
+	if err != nil {
+		WriteAPIError(w, 404, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, 200, v)
+
+	case "PUT":
+		var new_v Variant
+
+		err := RequirePermission(mem, "products.edit")
+		if err == nil {
+			err = DecodeJSON(w, r, &new_v)
+		}
+		if err == nil {
+			new_v.Id = v.Id
+			new_v.Product = v.Product
+			if new_v.GroupPrices == nil {
+				new_v.GroupPrices = v.GroupPrices
+			}
+			err = CheckVariant(new_v, Database)
+		}
+		if err == nil {
+			err = UpdateVariant(new_v, Database)
+		}
+		if err == nil {
+			v, err = FetchVariant(v.Id, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, v)
+
+	case "DELETE":
+		err := RequirePermission(mem, "products.edit")
+		if err == nil {
+			err = RemoveVariant(v, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 204, nil)
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+	}
+}
+
+type APICartItem struct {
+	Product int64  `json:"product"`
+	Variant int64  `json:"variant"` // 0 for products without variants
+	Count   uint64 `json:"count"`
+}
+
+func APICart(id string, sess Session, mem Member, w http.ResponseWriter, r *http.Request) {
+	var itm APICartItem
+	var prodId int64
+	var err error
+
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	switch {
+	case id == "" && r.Method == "GET":
+
+	case id == "" && r.Method == "POST":
+		err = DecodeJSON(w, r, &itm)
+		if err == nil {
+			err = AddCartItem(itm.Product, itm.Variant, itm.Count, sess, Database)
+		}
+
+	case id != "" && r.Method == "PUT":
+		prodId, err = APIParseId(id)
+		if err == nil {
+			err = DecodeJSON(w, r, &itm)
+		}
+		if err == nil {
+			err = SetCartItem(prodId, itm.Variant, itm.Count, sess, Database)
+		}
+
+	case id != "" && r.Method == "DELETE":
+		var varId int64
+		prodId, err = APIParseId(id)
+		if err == nil && r.URL.Query().Get("variant") != "" {
+			varId, err = APIParseId(r.URL.Query().Get("variant"))
+		}
+		if err == nil {
+			err = RemoveCartItem(prodId, varId, sess, Database)
+		}
+		if err == nil {
+			WriteJSON(w, 204, nil)
+			return
+		}
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+		return
+	}
+
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	cart, err := FetchCart(sess, mem, Database)
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	WriteJSON(w, 200, struct {
+		Items []CartItem `json:"items"`
+		Sum   uint64     `json:"sum"`
+	}{
+		cart,
+		CartSum(cart),
+	})
+}
+
+type APIOrderStatus struct {
+	Status string `json:"status"`
+}
+
+func APIOrders(id string, sess Session, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			err := RequirePermission(mem, "orders.view")
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			rcpts, err := FetchNamedReceipts(Database)
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			WriteJSON(w, 200, rcpts)
+
+		case "POST":
+			var checkout Checkout
+			err := DecodeOptionalJSON(w, r, &checkout)
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			rcpt, err := PlaceOrder(sess, mem, checkout, Database)
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			w.Header().Set("Location", GlobalConfig.Location+APIPrefix+"orders/"+strconv.FormatInt(rcpt.Order.Id, 10))
+			WriteJSON(w, 201, rcpt)
+
+		default:
+			WriteAPIError(w, 405, "Method not supported")
+		}
+		return
+	}
+
+	if id == "my" {
+		if r.Method != "GET" {
+			WriteAPIError(w, 405, "Method not supported")
+			return
+		}
+
+		err := APIRequireMember(mem)
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		rcpts, err := FetchMemberReceipts(mem.Id, Database)
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, rcpts)
+		return
+	}
+
+	ordId, err := APIParseId(id)
+	if err == nil {
+		err = APIRequireMember(mem)
+	}
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	rcpt, err := FetchReceipt(ordId, Database)
+
+	// Members only get to see their own orders
+	if err != nil || (!HasPermission(mem, "orders.view") && rcpt.Order.Member != mem.Id) {
+		WriteAPIError(w, 404, "No such order")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, 200, rcpt)
+
+	case "PUT":
+		var stat APIOrderStatus
+
+		err := APIRequireMember(mem)
+		if err == nil {
+			err = DecodeJSON(w, r, &stat)
+		}
+		if err == nil && !CanSetOrderStatus(mem, stat.Status) {
+			err = NewStatusError(403, "Insufficient permissions")
+		}
+		if err == nil {
+			rcpt, err = ChangeOrderStatus(rcpt, stat.Status, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, rcpt)
+
+	case "DELETE":
+		err := RequirePermission(mem, "orders.delete")
+		if err == nil {
+			err = RemoveOrder(rcpt, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 204, nil)
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+	}
+}
+
+type APIMember struct {
+	Name   string `json:"name"`
+	EMail  string `json:"email"`
+	Passwd string `json:"passwd"`
+	Group  string `json:"group"`
+}
+
+// Validates the fields the same way the HTML forms are.
+func MemberFromAPI(in APIMember) (Member, error) {
+	mem, err := MemberFromForm(url.Values{
+		"name":   {in.Name},
+		"email":  {in.EMail},
+		"passwd": {in.Passwd},
+		"group":  {in.Group},
+	})
+
+	if err != nil {
+		return Member{}, NewStatusError(400, "%s", err.Error())
+	}
+	return mem, nil
+}
+
+func APIMembers(id string, sess Session, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			err := RequirePermission(mem, "members.view")
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			mems, err := FetchMembers(Database)
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			WriteJSON(w, 200, mems)
+
+		case "POST":
+			var in APIMember
+
+			err := DecodeJSON(w, r, &in)
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			new_mem, err := MemberFromAPI(in)
+			if err == nil {
+				new_mem, err = RegisterMember(new_mem, sess, Database)
+			}
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			w.Header().Set("Location", GlobalConfig.Location+APIPrefix+"members/"+strconv.FormatInt(new_mem.Id, 10))
+			WriteJSON(w, 201, new_mem)
+
+		default:
+			WriteAPIError(w, 405, "Method not supported")
+		}
+		return
+	}
+
+	var memId int64
+	var err error
+
+	if id == "me" {
+		memId = mem.Id
+		err = APIRequireMember(mem)
+	} else {
+		memId, err = APIParseId(id)
+		if err == nil {
+			err = APIRequireMember(mem)
+		}
+	}
+
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	if !HasPermission(mem, "members.view") && memId != mem.Id {
+		WriteAPIError(w, 403, "Insufficient permissions")
+		return
+	}
+
+	mem2, err := FetchMember(memId, Database)
+	if err != nil {
+		WriteAPIError(w, 404, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, 200, mem2)
+
+	case "PUT":
+		var in APIMember
+
+		err := RequirePermission(mem, "members.manage")
+		if err == nil && !CanManageGroup(mem, mem2.Group) {
+			err = NewStatusError(403, "Insufficient permissions")
+		}
+		if err == nil {
+			err = DecodeJSON(w, r, &in)
+		}
+		if err == nil {
+			var new_mem Member
+
+			new_mem, err = MemberFromAPI(in)
+			if err == nil && !CanManageGroup(mem, new_mem.Group) {
+				err = NewStatusError(403, "Insufficient permissions")
+			}
+			if err == nil {
+				new_mem.Id = mem2.Id
+				err = UpdateMember(new_mem, Database)
+			}
+		}
+		if err == nil {
+			mem2, err = FetchMember(mem2.Id, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, mem2)
+
+	case "DELETE":
+		err := RequirePermission(mem, "members.manage")
+		if err == nil && !CanManageGroup(mem, mem2.Group) {
+			err = NewStatusError(403, "Insufficient permissions")
+		}
+		if err == nil {
+			err = RemoveMember(mem2, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 204, nil)
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+	}
+}
+
+// Address book of the current member.
+func APIAddresses(id string, mem Member, w http.ResponseWriter, r *http.Request) {
+	err := APIRequireMember(mem)
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	switch {
+	case id == "" && r.Method == "GET":
+		addrs, err := FetchAddresses(mem.Id, Database)
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, addrs)
+
+	case id == "" && r.Method == "POST":
+		var addr Address
+		err := DecodeJSON(w, r, &addr)
+		if err == nil {
+			addr.Id = 0
+			addr.Member = mem.Id
+			addr, err = InsertAddress(addr, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		w.Header().Set("Location", GlobalConfig.Location+APIPrefix+"addresses/"+strconv.FormatInt(addr.Id, 10))
+		WriteJSON(w, 201, addr)
+
+	case id != "" && r.Method == "DELETE":
+		addrId, err := APIParseId(id)
+		var addr Address
+		if err == nil {
+			addr, err = FetchMemberAddress(addrId, mem, Database)
+		}
+		if err == nil {
+			err = RemoveAddress(addr, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 204, nil)
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+	}
+}
+
+// Discount codes, for members allowed to manage them.
+func APICoupons(id string, mem Member, w http.ResponseWriter, r *http.Request) {
+	err := RequirePermission(mem, "coupons.manage")
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	defer DatabaseMutex.Unlock()
+
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			coupons, err := FetchCoupons(Database)
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			WriteJSON(w, 200, coupons)
+
+		case "POST":
+			var c Coupon
+			err := DecodeJSON(w, r, &c)
+			if err == nil {
+				c.Id = 0
+				c.Code = NormalizeCouponCode(c.Code)
+				err = CheckCoupon(c, Database)
+			}
+			if err == nil {
+				c, err = InsertCoupon(c, Database)
+			}
+			if err == nil {
+				c, err = FetchCoupon(c.Id, Database)
+			}
+			if err != nil {
+				WriteAPIErr(w, err)
+				return
+			}
+
+			w.Header().Set("Location", GlobalConfig.Location+APIPrefix+"coupons/"+strconv.FormatInt(c.Id, 10))
+			WriteJSON(w, 201, c)
+
+		default:
+			WriteAPIError(w, 405, "Method not supported")
+		}
+		return
+	}
+
+	couponId, err := APIParseId(id)
+	if err != nil {
+		WriteAPIErr(w, err)
+		return
+	}
+
+	c, err := FetchCoupon(couponId, Database)
+	if err != nil {
+		WriteAPIError(w, 404, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, 200, c)
+
+	case "PUT":
+		var new_c Coupon
+		err := DecodeJSON(w, r, &new_c)
+		if err == nil {
+			new_c.Id = c.Id
+			new_c.Code = NormalizeCouponCode(new_c.Code)
+			err = CheckCoupon(new_c, Database)
+		}
+		if err == nil {
+			err = UpdateCoupon(new_c, Database)
+		}
+		if err == nil {
+			c, err = FetchCoupon(c.Id, Database)
+		}
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 200, c)
+
+	case "DELETE":
+		err := RemoveCoupon(c, Database)
+		if err != nil {
+			WriteAPIErr(w, err)
+			return
+		}
+
+		WriteJSON(w, 204, nil)
+
+	default:
+		WriteAPIError(w, 405, "Method not supported")
+	}
+}
+
+func HandleAPI(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		WriteAPIError(w, 500, "Failed to fetch member: "+err.Error())
+		return
+	}
+
+	fmt.Println("HandleAPI() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	res, id := APIPath(r)
+
+	switch res {
+	case "session":
+		APIGetSession(sess, mem, w, r)
+	case "categories":
+		APICategories(mem, w, r)
+	case "products":
+		APIProducts(id, mem, w, r)
+	case "variants":
+		APIVariants(id, mem, w, r)
+	case "cart":
+		APICart(id, sess, mem, w, r)
+	case "orders":
+		APIOrders(id, sess, mem, w, r)
+	case "members":
+		APIMembers(id, sess, mem, w, r)
+	case "addresses":
+		APIAddresses(id, mem, w, r)
+	case "coupons":
+		APICoupons(id, mem, w, r)
+	default:
+		WriteAPIError(w, 404, "Not found")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAPIUpdatedProduct(t *testing.T) {
+	stored := Product{
+		Id:          7,
+		Name:        "Shirt",
+		Price:       2000,
+		GroupPrices: map[string]uint64{"member": 1500},
+		Images:      []string{"a.png", "b.png"},
+		Variants:    []Variant{{Id: 1, Product: 7, Name: "M"}},
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		prices map[string]uint64
+		err    bool
+	}{
+		{"group prices left out", `{"id": 9, "name": "Shirt", "price": 2200}`, map[string]uint64{"member": 1500}, false},
+		{"group prices null", `{"name": "Shirt", "groupPrices": null}`, map[string]uint64{"member": 1500}, false},
+		{"group prices changed", `{"name": "Shirt", "groupPrices": {"member": 1000}}`, map[string]uint64{"member": 1000}, false},
+		{"group prices removed", `{"name": "Shirt", "groupPrices": {}}`, map[string]uint64{}, false},
+		{"images repeated", `{"name": "Shirt", "images": ["a.png", "b.png"], "variants": []}`, map[string]uint64{"member": 1500}, false},
+		{"images removed", `{"name": "Shirt", "images": []}`, nil, true},
+		{"images reordered", `{"name": "Shirt", "images": ["b.png", "a.png"]}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		var body Product
+		err := json.Unmarshal([]byte(tt.body), &body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		prod, err := apiUpdatedProduct(stored, body)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err {
+			if ErrorStatus(err) != 400 {
+				t.Errorf("%s: status %d, want 400", tt.name, ErrorStatus(err))
+			}
+			continue
+		}
+
+		if prod.Id != stored.Id || !reflect.DeepEqual(prod.GroupPrices, tt.prices) ||
+			!reflect.DeepEqual(prod.Images, stored.Images) || !reflect.DeepEqual(prod.Variants, stored.Variants) {
+			t.Errorf("%s: got %+v", tt.name, prod)
+		}
+	}
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bank statements are imported from CAMT.053 XML, MT940 or CSV exports. Every
+// incoming payment is matched to an order by the UUID the customer was asked
+// to use as reference. Orders paid in full are moved to "paid", everything
+// else is kept for review by an admin.
+
+// Human readable names of the results of matching a payment
+var BankResultNames = map[string]string{
+	"paid":      "Bestellung bezahlt",
+	"partial":   "Teilzahlung",
+	"overpaid":  "Überzahlung",
+	"closed":    "Bestellung wartet nicht auf Zahlung",
+	"unmatched": "Keine Bestellung gefunden",
+	"duplicate": "Bereits importiert",
+	"deleted":   "Bestellung gelöscht",
+}
+
+type BankTransaction struct {
+	Id           int64
+	Date         int64  // Unix time
+	Amount       uint64 // Cents
+	Reference    string
+	Counterparty string
+	BankRef      string // Reference assigned by the bank, if any
+	Order        int64  // 0 if unmatched
+	Result       string
+	Reviewed     bool
+	Imported     int64 // Unix time
+}
+
+func BankTransactionFromRow(rows *sql.Rows) (BankTransaction, error) {
+	var txn BankTransaction
+	var hash string
+
+	err := rows.Scan(&txn.Id, &hash, &txn.Date, &txn.Amount, &txn.Reference, &txn.Counterparty, &txn.BankRef, &txn.Order, &txn.Result, &txn.Reviewed, &txn.Imported)
+	return txn, err
+}
+
+// Identifies a transaction across imports, so uploading overlapping
+// statements does not count payments twice.
+func (txn BankTransaction) Hash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%d\x00%s\x00%s\x00%s", txn.Date, txn.Amount, txn.Reference, txn.Counterparty, txn.BankRef)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Parses amounts like "1.234,56", "1234.5" or "12" into cents.
+func ParseCents(s string) (uint64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "EUR"))
+	s = strings.TrimPrefix(strings.Replace(s, " ", "", -1), "+")
+
+	// The last separator followed by one or two digits is the decimal one
+	whole, frac := s, ""
+	if i := strings.LastIndexAny(s, ",."); i >= 0 && len(s)-i-1 <= 2 {
+		whole, frac = s[:i], s[i+1:]
+	}
+
+	whole = strings.Replace(strings.Replace(whole, ".", "", -1), ",", "", -1)
+	if whole == "" {
+		whole = "0"
+	}
+
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	cents, err := strconv.ParseUint(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid amount '%s'", s)
+	}
+
+	return cents, nil
+}
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtDetails struct {
+	Amount       camtAmount `xml:"Amt"`
+	TxAmount     camtAmount `xml:"AmtDtls>TxAmt>Amt"`
+	Unstructured []string   `xml:"RmtInf>Ustrd"`
+	Structured   []string   `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+	EndToEndId   string     `xml:"Refs>EndToEndId"`
+	Debtor       string     `xml:"RltdPties>Dbtr>Nm"`
+	DebtorParty  string     `xml:"RltdPties>Dbtr>Pty>Nm"`
+}
+
+type camtEntry struct {
+	Amount      camtAmount    `xml:"Amt"`
+	Indicator   string        `xml:"CdtDbtInd"`
+	Reversal    bool          `xml:"RvslInd"`
+	BookingDate string        `xml:"BookgDt>Dt"`
+	BookingTime string        `xml:"BookgDt>DtTm"`
+	BankRef     string        `xml:"AcctSvcrRef"`
+	Info        string        `xml:"AddtlNtryInf"`
+	Details     []camtDetails `xml:"NtryDtls>TxDtls"`
+}
+
+type camtDocument struct {
+	Entries []camtEntry `xml:"BkToCstmrStmt>Stmt>Ntry"`
+}
+
+func camtTransaction(date int64, amount camtAmount, bankRef string, dtls camtDetails, info string) (BankTransaction, error) {
+	if amount.Currency != "" && amount.Currency != "EUR" {
+		return BankTransaction{}, fmt.Errorf("Unsupported currency '%s'", amount.Currency)
+	}
+
+	cents, err := ParseCents(amount.Value)
+	if err != nil {
+		return BankTransaction{}, err
+	}
+
+	ref := strings.Join(append(dtls.Unstructured, dtls.Structured...), " ")
+	if dtls.EndToEndId != "" && dtls.EndToEndId != "NOTPROVIDED" {
+		ref = strings.TrimSpace(ref + " " + dtls.EndToEndId)
+	}
+	if ref == "" {
+		ref = info
+	}
+
+	name := dtls.Debtor
+	if name == "" {
+		name = dtls.DebtorParty
+	}
+
+	return BankTransaction{Date: date, Amount: cents, Reference: ref, Counterparty: name, BankRef: bankRef}, nil
+}
+
+// Incoming payments of an ISO 20022 CAMT.053 statement. Batch entries are
+// split into their transactions.
+func ParseCAMT053(data []byte) ([]BankTransaction, error) {
+	var doc camtDocument
+
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	txns := make([]BankTransaction, 0)
+	for _, ntry := range doc.Entries {
+		// Reversed debits are credits and vice versa
+		if (ntry.Indicator == "CRDT") == ntry.Reversal {
+			continue
+		}
+
+		var date time.Time
+		if ntry.BookingDate != "" {
+			date, err = time.ParseInLocation("2006-01-02", ntry.BookingDate, time.Local)
+		} else {
+			date, err = time.Parse(time.RFC3339, ntry.BookingTime)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid booking date: %s", err.Error())
+		}
+
+		if len(ntry.Details) > 1 {
+			for _, dtls := range ntry.Details {
+				amt := dtls.Amount
+				if amt.Value == "" {
+					amt = dtls.TxAmount
+				}
+
+				txn, err := camtTransaction(date.Unix(), amt, ntry.BankRef, dtls, ntry.Info)
+				if err != nil {
+					return nil, err
+				}
+				txns = append(txns, txn)
+			}
+		} else {
+			var dtls camtDetails
+			if len(ntry.Details) == 1 {
+				dtls = ntry.Details[0]
+			}
+
+			txn, err := camtTransaction(date.Unix(), ntry.Amount, ntry.BankRef, dtls, ntry.Info)
+			if err != nil {
+				return nil, err
+			}
+			txns = append(txns, txn)
+		}
+	}
+
+	return txns, nil
+}
+
+var mt940Field = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):`)
+var mt940Statement = regexp.MustCompile(`^([0-9]{6})([0-9]{4})?(RC|RD|C|D)[A-Z]?([0-9]+,[0-9]*)(.*)$`)
+var mt940Subfield = regexp.MustCompile(`\?([0-9]{2})`)
+
+// Incoming payments of a SWIFT MT940 statement. Structured :86: fields as used
+// by German banks are split into reference and counterparty, unstructured ones
+// are used as reference as a whole.
+func ParseMT940(data []byte) ([]BankTransaction, error) {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+
+	// Join continuation lines with the field they belong to
+	fields := make([][2]string, 0)
+	for _, line := range lines {
+		if m := mt940Field.FindStringSubmatch(line); m != nil {
+			fields = append(fields, [2]string{m[1], line[len(m[0]):]})
+		} else if len(fields) > 0 && line != "-" {
+			fields[len(fields)-1][1] += "\n" + line
+		}
+	}
+
+	txns := make([]BankTransaction, 0)
+	credit := false
+
+	for _, f := range fields {
+		switch f[0] {
+		case "61":
+			line := strings.SplitN(f[1], "\n", 2)
+			m := mt940Statement.FindStringSubmatch(line[0])
+			if m == nil {
+				return nil, fmt.Errorf("Invalid statement line '%s'", line[0])
+			}
+
+			date, err := time.ParseInLocation("060102", m[1], time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value date: %s", err.Error())
+			}
+
+			cents, err := ParseCents(m[4])
+			if err != nil {
+				return nil, err
+			}
+
+			credit = m[3] == "C" || m[3] == "RD"
+			if !credit {
+				continue
+			}
+
+			bankRef := ""
+			if i := strings.Index(m[5], "//"); i >= 0 {
+				bankRef = m[5][i+2:]
+			}
+
+			txns = append(txns, BankTransaction{Date: date.Unix(), Amount: cents, BankRef: bankRef})
+
+		case "86":
+			if !credit || len(txns) == 0 || txns[len(txns)-1].Reference != "" {
+				continue
+			}
+
+			txn := &txns[len(txns)-1]
+			info := strings.Replace(f[1], "\n", "", -1)
+			idx := mt940Subfield.FindAllStringSubmatchIndex(info, -1)
+
+			if len(idx) == 0 {
+				txn.Reference = info
+				continue
+			}
+
+			ref, name := "", ""
+			for i, m := range idx {
+				end := len(info)
+				if i+1 < len(idx) {
+					end = idx[i+1][0]
+				}
+
+				code, _ := strconv.Atoi(info[m[2]:m[3]])
+				val := info[m[1]:end]
+
+				if (code >= 20 && code <= 29) || (code >= 60 && code <= 63) {
+					ref += val
+				} else if code == 32 || code == 33 {
+					name += val
+				}
+			}
+
+			txn.Reference = ref
+			txn.Counterparty = name
+		}
+	}
+
+	return txns, nil
+}
+
+// Column names used by common online banking CSV exports
+var csvColumns = map[string][]string{
+	"date":         {"buchungstag", "buchungsdatum", "datum", "valutadatum", "date", "booking date"},
+	"amount":       {"betrag", "umsatz", "amount"},
+	"reference":    {"verwendungszweck", "reference", "purpose", "remittance information"},
+	"counterparty": {"beguenstigter/zahlungspflichtiger", "name zahlungsbeteiligter", "auftraggeber", "zahlungspflichtiger", "name", "counterparty", "payer"},
+}
+
+var csvDateFormats = []string{"02.01.2006", "02.01.06", "2006-01-02"}
+
+// Incoming payments of a CSV export. Lines before the header are skipped, the
+// columns are found by their names and the delimiter may be ";" or ",".
+func ParseStatementCSV(data []byte) ([]BankTransaction, error) {
+	rd := csv.NewReader(bytes.NewReader(data))
+	rd.LazyQuotes = true
+	rd.FieldsPerRecord = -1
+
+	if bytes.Count(data, []byte(";")) > bytes.Count(data, []byte(",")) {
+		rd.Comma = ';'
+	}
+
+	recs, err := rd.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var cols map[string]int
+	txns := make([]BankTransaction, 0)
+
+	for _, rec := range recs {
+		if cols == nil {
+			found := make(map[string]int)
+			for i, name := range rec {
+				name = strings.ToLower(strings.TrimSpace(name))
+				for col, names := range csvColumns {
+					if _, ok := found[col]; ok {
+						continue
+					}
+					for _, n := range names {
+						if strings.HasPrefix(name, n) {
+							found[col] = i
+							break
+						}
+					}
+				}
+			}
+
+			_, okDate := found["date"]
+			_, okAmount := found["amount"]
+			_, okRef := found["reference"]
+			if okDate && okAmount && okRef {
+				cols = found
+			}
+			continue
+		}
+
+		get := func(col string) string {
+			i, ok := cols[col]
+			if !ok || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+
+		amount := get("amount")
+		if amount == "" || strings.HasPrefix(amount, "-") {
+			continue
+		}
+
+		cents, err := ParseCents(amount)
+		if err != nil {
+			return nil, err
+		}
+
+		var date time.Time
+		for _, f := range csvDateFormats {
+			date, err = time.ParseInLocation(f, get("date"), time.Local)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date '%s'", get("date"))
+		}
+
+		txns = append(txns, BankTransaction{Date: date.Unix(), Amount: cents, Reference: get("reference"), Counterparty: get("counterparty")})
+	}
+
+	if cols == nil {
+		return nil, errors.New("No header with date, amount and reference columns found")
+	}
+
+	return txns, nil
+}
+
+// Incoming payments of a statement in any of the supported formats.
+func ParseStatement(data []byte) ([]BankTransaction, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return ParseCAMT053(trimmed)
+	}
+
+	if bytes.Contains(trimmed, []byte(":61:")) && bytes.Contains(trimmed, []byte(":20:")) {
+		return ParseMT940(trimmed)
+	}
+
+	return ParseStatementCSV(trimmed)
+}
+
+var orderReference = regexp.MustCompile(`(?i)[0-9a-f]{8}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{12}`)
+
+// UUID of the order a payment reference names, if any. Banks wrap long
+// references, so whitespace is ignored.
+func OrderReference(ref string) string {
+	m := orderReference.FindString(strings.Join(strings.Fields(ref), ""))
+	if m == "" {
+		return ""
+	}
+
+	m = strings.ToLower(strings.Replace(m, "-", "", -1))
+	return m[0:8] + "-" + m[8:12] + "-" + m[12:16] + "-" + m[16:20] + "-" + m[20:32]
+}
+
+// Sum of all payments recorded for the order.
+func OrderPayments(ordId int64, database *sql.DB) (uint64, error) {
+	var sum uint64
+
+	err := database.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM bank_transactions WHERE orderid = ?", ordId).Scan(&sum)
+	return sum, err
+}
+
+// Matches a new payment to its order and records it. Orders awaiting payment
+// that are paid in full are moved to "paid".
+func ImportBankTransaction(txn BankTransaction, database *sql.DB) (BankTransaction, error) {
+	hash := txn.Hash()
+
+	var cnt int64
+	err := database.QueryRow("SELECT COUNT(*) FROM bank_transactions WHERE hash = ?", hash).Scan(&cnt)
+	if err != nil {
+		return BankTransaction{}, err
+	}
+
+	if cnt > 0 {
+		txn.Result = "duplicate"
+		return txn, nil
+	}
+
+	txn.Result = "unmatched"
+	txn.Imported = time.Now().Unix()
+
+	var rcpt Receipt
+	if uuid := OrderReference(txn.Reference); uuid != "" {
+		rcpt, err = FetchReceiptByUuid(uuid, database)
+		if err == nil {
+			txn.Order = rcpt.Order.Id
+		}
+	}
+
+	if txn.Order != 0 {
+		paid, err := OrderPayments(txn.Order, database)
+		if err != nil {
+			return BankTransaction{}, err
+		}
+
+		if rcpt.Order.Status != "new" {
+			txn.Result = "closed"
+		} else if paid+txn.Amount < rcpt.Sum {
+			txn.Result = "partial"
+		} else if paid+txn.Amount > rcpt.Sum {
+			txn.Result = "overpaid"
+		} else {
+			txn.Result = "paid"
+		}
+	}
+
+	txn.Reviewed = txn.Result == "paid"
+	res, err := database.Exec("INSERT INTO bank_transactions VALUES ( NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? )", hash, txn.Date, txn.Amount, txn.Reference, txn.Counterparty, txn.BankRef, txn.Order, txn.Result, txn.Reviewed, txn.Imported)
+	if err != nil {
+		return BankTransaction{}, err
+	}
+
+	txn.Id, err = res.LastInsertId()
+	if err != nil {
+		return BankTransaction{}, err
+	}
+
+	if txn.Result == "paid" {
+		_, err = ChangeOrderStatus(rcpt, "paid", database)
+		if err != nil {
+			return BankTransaction{}, err
+		}
+
+		// Earlier partial payments of the order are settled now
+		_, err = database.Exec("UPDATE bank_transactions SET reviewed = 1 WHERE orderid = ?", txn.Order)
+		if err != nil {
+			return BankTransaction{}, err
+		}
+	}
+
+	return txn, nil
+}
+
+type BankMatch struct {
+	Transaction BankTransaction
+	Receipt     Receipt // Zero if the payment matches no order
+	Paid        uint64  // All payments recorded for the order
+}
+
+func FetchBankMatch(txn BankTransaction, database *sql.DB) (BankMatch, error) {
+	if txn.Order == 0 {
+		return BankMatch{Transaction: txn}, nil
+	}
+
+	rcpt, err := FetchReceipt(txn.Order, database)
+	if err != nil {
+		// The order was deleted since
+		return BankMatch{Transaction: txn}, nil
+	}
+
+	paid, err := OrderPayments(txn.Order, database)
+	return BankMatch{txn, rcpt, paid}, err
+}
+
+// Payments that need to be looked at by an admin.
+func FetchUnreviewedBankMatches(database *sql.DB) ([]BankMatch, error) {
+	rows, err := database.Query("SELECT * FROM bank_transactions WHERE reviewed = 0 ORDER BY date, id")
+	if err != nil {
+		return nil, err
+	}
+
+	txns := make([]BankTransaction, 0)
+	for rows.Next() {
+		txn, err := BankTransactionFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		txns = append(txns, txn)
+	}
+	rows.Close()
+
+	matches := make([]BankMatch, 0)
+	for _, txn := range txns {
+		m, err := FetchBankMatch(txn, database)
+		if err != nil {
+			return nil, err
+		}
+
+		matches = append(matches, m)
+	}
+
+	return matches, nil
+}
+
+func BankResultName(result string) string {
+	if name, ok := BankResultNames[result]; ok {
+		return name
+	}
+	return "Unbekannt"
+}
+
+func renderBank(mem Member, report []BankMatch, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	review, err := FetchUnreviewedBankMatches(Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch payments: "+err.Error(), 500)
+		return
+	}
+
+	meta := struct {
+		Report []BankMatch
+		Review []BankMatch
+	}{
+		report,
+		review,
+	}
+
+	RenderTemplate(w, r, "bank/list", "", mem, meta)
+}
+
+// Imports all statements uploaded in the "statements" field and shows what
+// became of each payment.
+func PostBankStatements(mem Member, w http.ResponseWriter, r *http.Request) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["statements"]) == 0 {
+		http.Error(w, "No statement uploaded", 400)
+		return
+	}
+
+	txns := make([]BankTransaction, 0)
+	for _, fh := range r.MultipartForm.File["statements"] {
+		fd, err := fh.Open()
+		if err != nil {
+			http.Error(w, "Failed to read statement: "+err.Error(), 500)
+			return
+		}
+
+		data, err := ioutil.ReadAll(fd)
+		fd.Close()
+
+		if err != nil {
+			http.Error(w, "Failed to read statement: "+err.Error(), 500)
+			return
+		}
+
+		parsed, err := ParseStatement(data)
+		if err != nil {
+			http.Error(w, "Failed to parse "+fh.Filename+": "+err.Error(), 400)
+			return
+		}
+
+		txns = append(txns, parsed...)
+	}
+
+	report := make([]BankMatch, 0)
+
+	DatabaseMutex.Lock()
+	for _, txn := range txns {
+		txn, err := ImportBankTransaction(txn, Database)
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, "Failed to import payment: "+err.Error(), 500)
+			return
+		}
+
+		m, err := FetchBankMatch(txn, Database)
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, "Failed to import payment: "+err.Error(), 500)
+			return
+		}
+
+		report = append(report, m)
+	}
+	DatabaseMutex.Unlock()
+
+	renderBank(mem, report, w, r)
+}
+
+// Marks the payment as dealt with, e.g. after refunding an overpayment.
+func PutBankTransaction(txnId int64, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	res, err := Database.Exec("UPDATE bank_transactions SET reviewed = 1 WHERE id = ?", txnId)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to update payment: "+err.Error(), 500)
+		return
+	}
+
+	if cnt, err := res.RowsAffected(); err == nil && cnt == 0 {
+		http.Error(w, "Payment not found", 404)
+		return
+	}
+
+	http.Redirect(w, r, "/bank/", 301)
+}
+
+func HandleBank(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	if !HasPermission(mem, "bank.import") {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	fmt.Println("HandleBank() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	meth := r.Method
+	if r.Method == "POST" {
+		err := ParseAnyForm(r)
+
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		meths, ok := r.PostForm["_method"]
+		if ok && len(meths) == 1 && len(meths[0]) > 0 {
+			meth = meths[0]
+		}
+	}
+
+	if r.URL.Path == "/bank" || r.URL.Path == "/bank/" {
+		if meth == "GET" {
+			renderBank(mem, nil, w, r)
+		} else if meth == "POST" {
+			PostBankStatements(mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		txnId, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/bank/"), 10, 64)
+
+		if err != nil {
+			http.Error(w, "Payment not found: "+err.Error(), 404)
+			return
+		}
+
+		if meth == "PUT" {
+			PutBankTransaction(txnId, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	}
+}
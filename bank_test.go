@@ -0,0 +1,286 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		in    string
+		cents uint64
+		err   bool
+	}{
+		{"12", 1200, false},
+		{"12,5", 1250, false},
+		{"12.5", 1250, false},
+		{"0,01", 1, false},
+		{",50", 50, false},
+		{"1234.5", 123450, false},
+		{"1.234,56", 123456, false},
+		{"1,234.56", 123456, false},
+		{"1.234", 123400, false},
+		{"1.234.567,89", 123456789, false},
+		{" +1 234,56 EUR ", 123456, false},
+		{"20,00 EUR", 2000, false},
+		{"-5,00", 0, true},
+		{"zwölf", 0, true},
+		{"12,3x", 0, true},
+	}
+
+	for _, tt := range tests {
+		cents, err := ParseCents(tt.in)
+		if (err != nil) != tt.err || cents != tt.cents {
+			t.Errorf("ParseCents(%q) = %d, %v, want %d, error %v", tt.in, cents, err, tt.cents, tt.err)
+		}
+	}
+}
+
+func TestOrderReference(t *testing.T) {
+	const uuid = "3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b"
+
+	tests := []struct {
+		name string
+		ref  string
+		want string
+	}{
+		{"plain", uuid, uuid},
+		{"with text", "Bestellung " + uuid + " LABOR Shop", uuid},
+		{"upper case", "3F2A6C1E-9B4D-4E8F-A1B2-0C9D8E7F6A5B", uuid},
+		{"without dashes", "3f2a6c1e9b4d4e8fa1b20c9d8e7f6a5b", uuid},
+		{"wrapped across lines", "Bestellung 3f2a6c1e-9b4d-4e8f-a1\nb2-0c9d8e7f6a5b", uuid},
+		{"wrapped with spaces", "3f2a6c1e-9b4d-4e8f- a1b2-0c9d8e7f6a5b", uuid},
+		{"truncated", "3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5", ""},
+		{"not hex", "3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6x5b", ""},
+		{"none", "Mitgliedsbeitrag 2026", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := OrderReference(tt.ref); got != tt.want {
+			t.Errorf("%s: OrderReference(%q) = %q, want %q", tt.name, tt.ref, got, tt.want)
+		}
+	}
+}
+
+func day(s string) int64 {
+	d, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return d.Unix()
+}
+
+const camtExample = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+<BkToCstmrStmt><Stmt>
+	<Ntry>
+		<Amt Ccy="EUR">20.00</Amt>
+		<CdtDbtInd>CRDT</CdtDbtInd>
+		<BookgDt><Dt>2026-10-01</Dt></BookgDt>
+		<AcctSvcrRef>REF1</AcctSvcrRef>
+		<NtryDtls><TxDtls>
+			<Refs><EndToEndId>NOTPROVIDED</EndToEndId></Refs>
+			<RltdPties><Dbtr><Nm>Bob</Nm></Dbtr></RltdPties>
+			<RmtInf><Ustrd>Bestellung 3f2a6c1e-9b4d-4e8f-</Ustrd><Ustrd>a1b2-0c9d8e7f6a5b</Ustrd></RmtInf>
+		</TxDtls></NtryDtls>
+	</Ntry>
+	<Ntry>
+		<Amt Ccy="EUR">5.00</Amt>
+		<CdtDbtInd>DBIT</CdtDbtInd>
+		<BookgDt><Dt>2026-10-02</Dt></BookgDt>
+		<AddtlNtryInf>Kontofuehrung</AddtlNtryInf>
+	</Ntry>
+	<Ntry>
+		<Amt Ccy="EUR">7.50</Amt>
+		<CdtDbtInd>DBIT</CdtDbtInd>
+		<RvslInd>true</RvslInd>
+		<BookgDt><Dt>2026-10-03</Dt></BookgDt>
+		<AddtlNtryInf>Ruecklastschrift</AddtlNtryInf>
+	</Ntry>
+	<Ntry>
+		<Amt Ccy="EUR">9.00</Amt>
+		<CdtDbtInd>CRDT</CdtDbtInd>
+		<RvslInd>true</RvslInd>
+		<BookgDt><Dt>2026-10-04</Dt></BookgDt>
+	</Ntry>
+	<Ntry>
+		<Amt Ccy="EUR">30.00</Amt>
+		<CdtDbtInd>CRDT</CdtDbtInd>
+		<BookgDt><DtTm>2026-10-05T12:00:00Z</DtTm></BookgDt>
+		<AcctSvcrRef>BATCH</AcctSvcrRef>
+		<NtryDtls>
+			<TxDtls>
+				<Amt Ccy="EUR">10.00</Amt>
+				<Refs><EndToEndId>E2E-1</EndToEndId></Refs>
+				<RltdPties><Dbtr><Pty><Nm>Carol</Nm></Pty></Dbtr></RltdPties>
+				<RmtInf><Strd><CdtrRefInf><Ref>RF18</Ref></CdtrRefInf></Strd></RmtInf>
+			</TxDtls>
+			<TxDtls>
+				<AmtDtls><TxAmt><Amt Ccy="EUR">20.00</Amt></TxAmt></AmtDtls>
+				<RmtInf><Ustrd>Spende</Ustrd></RmtInf>
+			</TxDtls>
+		</NtryDtls>
+	</Ntry>
+</Stmt></BkToCstmrStmt>
+</Document>`
+
+func TestParseCAMT053(t *testing.T) {
+	txns, err := ParseCAMT053([]byte(camtExample))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, _ := time.Parse(time.RFC3339, "2026-10-05T12:00:00Z")
+	want := []BankTransaction{
+		{Date: day("2026-10-01"), Amount: 2000, Reference: "Bestellung 3f2a6c1e-9b4d-4e8f- a1b2-0c9d8e7f6a5b", Counterparty: "Bob", BankRef: "REF1"},
+		{Date: day("2026-10-03"), Amount: 750, Reference: "Ruecklastschrift"},
+		{Date: batch.Unix(), Amount: 1000, Reference: "RF18 E2E-1", Counterparty: "Carol", BankRef: "BATCH"},
+		{Date: batch.Unix(), Amount: 2000, Reference: "Spende", BankRef: "BATCH"},
+	}
+
+	if !reflect.DeepEqual(txns, want) {
+		t.Errorf("got  %+v\nwant %+v", txns, want)
+	}
+
+	if ref := OrderReference(txns[0].Reference); ref != "3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b" {
+		t.Errorf("reference split across lines not found, got %q", ref)
+	}
+}
+
+func TestParseCAMT053Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"currency", `<Document><BkToCstmrStmt><Stmt><Ntry><Amt Ccy="USD">1.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><BookgDt><Dt>2026-10-01</Dt></BookgDt></Ntry></Stmt></BkToCstmrStmt></Document>`},
+		{"date", `<Document><BkToCstmrStmt><Stmt><Ntry><Amt Ccy="EUR">1.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><BookgDt><Dt>01.10.2026</Dt></BookgDt></Ntry></Stmt></BkToCstmrStmt></Document>`},
+		{"amount", `<Document><BkToCstmrStmt><Stmt><Ntry><Amt Ccy="EUR">eins</Amt><CdtDbtInd>CRDT</CdtDbtInd><BookgDt><Dt>2026-10-01</Dt></BookgDt></Ntry></Stmt></BkToCstmrStmt></Document>`},
+		{"xml", `<Document><BkToCstmrStmt>`},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseCAMT053([]byte(tt.doc)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+const mt940Example = ":20:STARTUMSE\r\n" +
+	":25:43050001/33419177\r\n" +
+	":28C:00001/001\r\n" +
+	":60F:C261001EUR1000,00\r\n" +
+	":61:2610011001CR20,00NTRFNONREF//BANK1\r\n" +
+	":86:166?00GUTSCHRIFT?20Bestellung 3f2a6c1e-9b4d-4e8f\r\n" +
+	"?21-a1b2-0c9d8e7f6a5b?32Bob Beispiel\r\n" +
+	":61:2610021002DR5,00NMSCNONREF\r\n" +
+	":86:805?00ENTGELT?20Kontofuehrung\r\n" +
+	":61:2610031003RD7,5NRTINONREF\r\n" +
+	":86:Ruecklastschrift Beitrag\r\n" +
+	":61:2610041004RC9,00NRTINONREF\r\n" +
+	":86:166?20Storno\r\n" +
+	":62F:C261005EUR1000,00\r\n" +
+	"-\r\n"
+
+func TestParseMT940(t *testing.T) {
+	txns, err := ParseMT940([]byte(mt940Example))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BankTransaction{
+		{Date: day("2026-10-01"), Amount: 2000, Reference: "Bestellung 3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b", Counterparty: "Bob Beispiel", BankRef: "BANK1"},
+		{Date: day("2026-10-03"), Amount: 750, Reference: "Ruecklastschrift Beitrag"},
+	}
+
+	if !reflect.DeepEqual(txns, want) {
+		t.Errorf("got  %+v\nwant %+v", txns, want)
+	}
+
+	if ref := OrderReference(txns[0].Reference); ref != "3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b" {
+		t.Errorf("reference split across ?20/?21 not found, got %q", ref)
+	}
+}
+
+func TestParseMT940Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"thousands separator", ":61:261005C1.234,56NTRFNONREF\r\n"},
+		{"missing amount", ":61:261005CNTRFNONREF\r\n"},
+		{"invalid date", ":61:261305C20,00NTRFNONREF\r\n"},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseMT940([]byte(":20:STARTUMSE\r\n" + tt.line + "-\r\n")); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestParseStatementCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		want []BankTransaction
+		err  bool
+	}{
+		{
+			"german export with preamble",
+			"Kontoauszug;Girokonto\n\n" +
+				"Buchungstag;Valutadatum;Beguenstigter/Zahlungspflichtiger;Verwendungszweck;Betrag\n" +
+				"01.10.2026;01.10.2026;Bob;Bestellung 3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b;1.234,56\n" +
+				"02.10.2026;02.10.2026;Stadtwerke;Abschlag;-50,00\n" +
+				"03.10.26;03.10.26;\"Carol; Dave\";\"Spende\";5\n",
+			[]BankTransaction{
+				{Date: day("2026-10-01"), Amount: 123456, Reference: "Bestellung 3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b", Counterparty: "Bob"},
+				{Date: day("2026-10-03"), Amount: 500, Reference: "Spende", Counterparty: "Carol; Dave"},
+			},
+			false,
+		},
+		{
+			"english export",
+			"Date,Amount,Reference,Payer\n" +
+				"2026-10-01,20.5,Order,Bob\n" +
+				"2026-10-02,,Empty,Carol\n",
+			[]BankTransaction{
+				{Date: day("2026-10-01"), Amount: 2050, Reference: "Order", Counterparty: "Bob"},
+			},
+			false,
+		},
+		{"no header", "01.10.2026;20,00;Bestellung\n", nil, true},
+		{"invalid date", "Datum;Betrag;Verwendungszweck\n2026/10/01;20,00;x\n", nil, true},
+		{"invalid amount", "Datum;Betrag;Verwendungszweck\n01.10.2026;zwanzig;x\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		txns, err := ParseStatementCSV([]byte(tt.csv))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(txns, tt.want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.name, txns, tt.want)
+		}
+	}
+}
+
+func TestParseStatement(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		n    int
+	}{
+		{"camt with BOM", "\xef\xbb\xbf" + camtExample, 4},
+		{"csv", "Datum;Betrag;Verwendungszweck\n01.10.2026;20,00;x\n", 1},
+	}
+
+	for _, tt := range tests {
+		txns, err := ParseStatement([]byte(tt.data))
+		if err != nil || len(txns) != tt.n {
+			t.Errorf("%s: got %d transactions, %v, want %d", tt.name, len(txns), err, tt.n)
+		}
+	}
+}
@@ -3,346 +3,512 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Product.Price is the price of the variant if there is one.
 type CartItem struct {
-	Product    Product
-	Amount     uint64
-	NextAmount uint64
-	PrevAmount uint64
+	Product    Product  `json:"product"`
+	Variant    *Variant `json:"variant"` // Nil for products without variants
+	Amount     uint64   `json:"amount"`
+	TaxRate    uint64   `json:"taxRate"`  // Hundredths of a percent
+	Discount   uint64   `json:"discount"` // Taken off the price of all items of the line
+	NextAmount uint64   `json:"-"`
+	PrevAmount uint64   `json:"-"`
 }
 
-func AddToCart(form url.Values, member Member, session Session, w http.ResponseWriter, r *http.Request) {
-	// Product Id
-	ids, ok := form["id"]
-	if !ok || len(ids) != 1 || len(ids[0]) == 0 {
-		http.Error(w, "Missing or empty id", 400)
-		return
+// Name of the product and variant, e.g. "T-Shirt (M, schwarz)".
+func (itm CartItem) Name() string {
+	if itm.Variant != nil {
+		return itm.Product.Name + " (" + itm.Variant.Name + ")"
 	}
-	id := ids[0]
+	return itm.Product.Name
+}
 
-	// Count
-	counts, ok := form["count"]
-	if !ok || len(counts) != 1 || len(counts[0]) == 0 {
-		http.Error(w, "Missing or empty count", 400)
-		return
+// Session id and member the cart of the session is stored under. Carts of
+// members belong to the member, not the session, so they outlive it and show
+// up on every device the member logs in with.
+func CartOwner(session Session) (string, int64) {
+	if session.Member != 0 {
+		return "", session.Member
 	}
+	return session.Id, 0
+}
 
-	count, err := strconv.ParseUint(counts[0], 10, 64)
-	if err != nil || count == 0 {
-		http.Error(w, "Invalid count", 400)
-		return
+// Number of items of the product or variant that are in stock and not
+// reserved by carts other than the one of session. Only reservations younger
+// than SessionLifetime count. Products with variants are only available by
+// variant.
+func AvailableCount(prodId int64, varId int64, session Session, tx *sql.Tx) (uint64, error) {
+	var rows *sql.Rows
+	var err error
+
+	sessId, memId := CartOwner(session)
+	if varId == 0 {
+		rows, err = tx.Query("SELECT products.count - IFNULL((SELECT SUM(carts.count) FROM carts WHERE carts.product = products.id AND carts.variant = 0 AND carts.reserved >= ? AND NOT (carts.session = ? AND carts.member = ?)), 0), (SELECT COUNT(*) FROM variants WHERE variants.product = products.id) FROM products WHERE id = ?",
+			time.Now().Unix()-SessionLifetime, sessId, memId, prodId)
+	} else {
+		rows, err = tx.Query("SELECT variants.count - IFNULL((SELECT SUM(carts.count) FROM carts WHERE carts.variant = variants.id AND carts.reserved >= ? AND NOT (carts.session = ? AND carts.member = ?)), 0), 0 FROM variants WHERE id = ? AND product = ?",
+			time.Now().Unix()-SessionLifetime, sessId, memId, varId, prodId)
+	}
+	if err != nil {
+		return 0, err
 	}
 
-	DatabaseMutex.Lock()
+	if !rows.Next() {
+		rows.Close()
+		if varId != 0 {
+			return 0, NewStatusError(404, "No such variant")
+		}
+		return 0, NewStatusError(404, "No such product")
+	}
+
+	var avail, variants int64
+	err = rows.Scan(&avail, &variants)
+	rows.Close()
 
-	tx, err := Database.Begin()
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return 0, err
 	}
 
-	rows, err := tx.Query("SELECT count FROM products WHERE id = ?", id)
-	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+	if variants > 0 {
+		return 0, NewStatusError(400, "Please choose a variant")
 	}
 
-	if !rows.Next() {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: no such cart", 500)
-		return
+	if avail < 0 {
+		return 0, nil
 	}
+	return uint64(avail), nil
+}
 
-	var avail_count uint64
-	err = rows.Scan(&avail_count)
+// Number of items of the product or its variant currently reserved by active
+// carts. A variant of 0 counts items of products without variants.
+func ReservedCount(prodId int64, varId int64, database *sql.DB) (uint64, error) {
+	rows, err := database.Query("SELECT IFNULL(SUM(count), 0) FROM carts WHERE product = ? AND variant = ? AND reserved >= ?", prodId, varId, time.Now().Unix()-SessionLifetime)
 	if err != nil {
-		rows.Close()
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return 0, err
 	}
 
+	var cnt uint64
+	if rows.Next() {
+		err = rows.Scan(&cnt)
+	}
 	rows.Close()
 
-	if avail_count < count {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: no enough items in stock", 400)
-		return
+	return cnt, err
+}
+
+// Releases the reservations of all carts whose session expired. Carts of
+// members are kept, their reservations lapse until the member is back.
+func ReapReservations(database *sql.DB) (int64, error) {
+	res, err := database.Exec("DELETE FROM carts WHERE reserved < ? AND member = 0", time.Now().Unix()-SessionLifetime)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func StartReservationReaper(interval time.Duration) {
+	go func() {
+		for {
+			DatabaseMutex.Lock()
+			cnt, err := ReapReservations(Database)
+			DatabaseMutex.Unlock()
+
+			if err != nil {
+				log.Println("Failed to release expired reservations: " + err.Error())
+			} else if cnt > 0 {
+				log.Printf("Released %d expired reservations", cnt)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Puts count more items of the product or its variant into the cart of the
+// session.
+func AddCartItem(prodId int64, varId int64, count uint64, session Session, database *sql.DB) error {
+	if count == 0 {
+		return NewStatusError(400, "Invalid count")
 	}
 
-	_, err = tx.Exec("INSERT INTO carts VALUES ( ?, ?, ? )", id, session.Id, count)
+	tx, err := database.Begin()
 	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	res, err := tx.Exec("UPDATE products SET count = count - ? WHERE id = ?", count, id)
+	avail_count, err := AvailableCount(prodId, varId, session, tx)
 	if err != nil {
 		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	err = tx.Commit()
+	cur_count, in_cart, err := cartCount(prodId, varId, session, tx)
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		tx.Rollback()
+		return err
 	}
 
-	ar, err := res.RowsAffected()
+	if avail_count < cur_count+count {
+		tx.Rollback()
+		return NewStatusError(400, "no enough items in stock")
+	}
+
+	err = storeCartCount(prodId, varId, cur_count+count, in_cart, session, tx)
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		tx.Rollback()
+		return err
 	}
 
-	DatabaseMutex.Unlock()
+	return tx.Commit()
+}
 
+// Number of items of the product or variant in the cart of the session and
+// whether it is in there at all.
+func cartCount(prodId int64, varId int64, session Session, tx *sql.Tx) (uint64, bool, error) {
+	sessId, memId := CartOwner(session)
+	rows, err := tx.Query("SELECT count FROM carts WHERE product = ? AND variant = ? AND session = ? AND member = ?", prodId, varId, sessId, memId)
 	if err != nil {
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return 0, false, err
 	}
 
-	if ar != 1 {
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+	var cnt uint64
+	in_cart := rows.Next()
+	if in_cart {
+		err = rows.Scan(&cnt)
 	}
+	rows.Close()
 
-	http.Redirect(w, r, "/cart", 301)
+	return cnt, in_cart, err
 }
 
-func GetCart(member Member, session Session, w http.ResponseWriter, r *http.Request) {
-	DatabaseMutex.Lock()
+func storeCartCount(prodId int64, varId int64, count uint64, in_cart bool, session Session, tx *sql.Tx) error {
+	var err error
 
-	var rows *sql.Rows
-	rows, err := Database.Query("SELECT products.id,products.name,products.slug,products.description,products.price,products.count,carts.count as selected_count FROM carts JOIN products ON products.id = carts.product WHERE session = ?", session.Id)
+	sessId, memId := CartOwner(session)
+	if in_cart {
+		_, err = tx.Exec("UPDATE carts SET count = ?, reserved = ? WHERE product = ? AND variant = ? AND session = ? AND member = ?", count, time.Now().Unix(), prodId, varId, sessId, memId)
+	} else {
+		_, err = tx.Exec("INSERT INTO carts VALUES ( ?, ?, ?, ?, ?, ? )", prodId, sessId, count, time.Now().Unix(), varId, memId)
+	}
+	return err
+}
 
+// Moves the cart of the session into the one of the member logging in with
+// it. Items already in the member's cart add up as far as they are in stock,
+// items not available anymore are dropped.
+func MergeCart(sess string, mem int64, database *sql.DB) error {
+	tx, err := database.Begin()
 	if err != nil {
-		http.Error(w, "Failed fetch cart: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	cart := make([]CartItem, 0)
+	rows, err := tx.Query("SELECT product, variant, count FROM carts WHERE session = ? AND member = 0", sess)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	type item struct {
+		Product, Variant int64
+		Count            uint64
+	}
+	items := make([]item, 0)
 	for rows.Next() {
-		var name, slug, desc string
-		var id int64
-		var price, count, amount uint64
+		var itm item
+		err = rows.Scan(&itm.Product, &itm.Variant, &itm.Count)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		items = append(items, itm)
+	}
+	rows.Close()
 
-		err := rows.Scan(&id, &name, &slug, &desc, &price, &count, &amount)
-		prod := Product{Id: id, Name: name, Slug: slug, Description: desc, Price: price, Count: count}
-		itm := CartItem{Product: prod, Amount: amount, NextAmount: amount + 1, PrevAmount: amount - 1}
+	_, err = tx.Exec("DELETE FROM carts WHERE session = ? AND member = 0", sess)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	owner := Session{Id: sess, Member: mem}
+	for _, itm := range items {
+		avail, err := AvailableCount(itm.Product, itm.Variant, owner, tx)
+		if err != nil && ErrorStatus(err) == 500 {
+			tx.Rollback()
+			return err
+		} else if err != nil {
+			// Product or variant is gone
+			continue
+		}
 
-		if err == nil {
-			cart = append(cart, itm)
+		cur_count, in_cart, err := cartCount(itm.Product, itm.Variant, owner, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
-	}
 
-	DatabaseMutex.Unlock()
+		count := cur_count + itm.Count
+		if count > avail {
+			count = avail
+		}
+		if count <= cur_count {
+			continue
+		}
 
-	RenderTemplate(w, "cart", "", member, cart)
+		err = storeCartCount(itm.Product, itm.Variant, count, in_cart, owner, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-func PutCartItem(prodId int64, member Member, session Session, w http.ResponseWriter, r *http.Request) {
-	// Amount
-	counts, ok := r.PostForm["count"]
-	if !ok || len(counts) != 1 || len(counts[0]) == 0 {
-		http.Error(w, "Missing or empty count", 400)
-		return
+// Sets the number of items of the product or its variant in the cart of the
+// session. A count of zero removes the item from the cart.
+func SetCartItem(prodId int64, varId int64, count uint64, session Session, database *sql.DB) error {
+	if count == 0 {
+		return RemoveCartItem(prodId, varId, session, database)
 	}
 
-	count, err := strconv.ParseUint(counts[0], 10, 64)
+	tx, err := database.Begin()
 	if err != nil {
-		http.Error(w, "Invalid count", 400)
-		return
+		return err
 	}
 
-	if count == 0 {
-		DeleteCartItem(prodId, member, session, w, r)
-		return
+	avail_count, err := AvailableCount(prodId, varId, session, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	DatabaseMutex.Lock()
-
-	tx, err := Database.Begin()
-	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+	if avail_count < count {
+		tx.Rollback()
+		return NewStatusError(400, "no enough items in stock")
 	}
 
-	rows, err := tx.Query("SELECT count FROM carts WHERE product = ? AND session = ?", prodId, session.Id)
+	sessId, memId := CartOwner(session)
+	res, err := tx.Exec("UPDATE carts SET count = ?, reserved = ? WHERE product = ? AND variant = ? AND session = ? AND member = ?", count, time.Now().Unix(), prodId, varId, sessId, memId)
 	if err != nil {
 		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	if !rows.Next() {
+	ar, err := res.RowsAffected()
+	if err != nil || ar == 0 {
 		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: no such cart", 500)
-		return
+		return NewStatusError(404, "no such cart")
 	}
 
-	var cur_count uint64
-	err = rows.Scan(&cur_count)
+	return tx.Commit()
+}
+
+func RemoveCartItem(prodId int64, varId int64, session Session, database *sql.DB) error {
+	sessId, memId := CartOwner(session)
+	res, err := database.Exec("DELETE FROM carts WHERE product = ? AND variant = ? AND session = ? AND member = ?", prodId, varId, sessId, memId)
 	if err != nil {
-		rows.Close()
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	rows.Close()
+	ar, err := res.RowsAffected()
+	if err != nil || ar == 0 {
+		return NewStatusError(404, "no such cart")
+	}
+
+	return nil
+}
 
-	rows, err = tx.Query("SELECT count FROM products WHERE id = ?", prodId)
+// Columns of products, variants and carts read by CartItemFromRow. The group
+// prices are NULL if the group pays the regular price.
+const cartItemColumns = "products.id,products.name,products.slug,products.description,products.price,product_prices.price,products.count,products.category,products.taxclass,products.weight," +
+	"IFNULL(variants.id, 0),IFNULL(variants.name, ''),IFNULL(variants.sku, ''),IFNULL(variants.price, 0),variant_prices.price,IFNULL(variants.count, 0),carts.count as selected_count"
+
+// Query of a cart with the columns read by CartItemFromRow. Takes the group of
+// the member, whose prices are used, twice and the owner of the cart as
+// returned by CartOwner.
+const cartItemQuery = "SELECT " + cartItemColumns + " FROM carts JOIN products ON products.id = carts.product LEFT JOIN variants ON variants.id = carts.variant " +
+	"LEFT JOIN product_prices ON product_prices.product = products.id AND product_prices.grp = ? " +
+	"LEFT JOIN variant_prices ON variant_prices.variant = carts.variant AND variant_prices.grp = ? WHERE carts.session = ? AND carts.member = ? ORDER BY carts.rowid"
+
+// Reads a row of cartItemQuery. The price of the item is the one members of
+// the group pay.
+func CartItemFromRow(rows *sql.Rows, group string) (CartItem, error) {
+	var prod Product
+	var v Variant
+	var prodPrice, varPrice sql.NullInt64
+	var amount uint64
+
+	err := rows.Scan(&prod.Id, &prod.Name, &prod.Slug, &prod.Description, &prod.Price, &prodPrice, &prod.Count, &prod.Category, &prod.TaxClass, &prod.Weight,
+		&v.Id, &v.Name, &v.SKU, &v.Price, &varPrice, &v.Count, &amount)
 	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return CartItem{}, err
 	}
 
-	if !rows.Next() {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: no such cart", 500)
-		return
+	if prodPrice.Valid {
+		prod.GroupPrices = map[string]uint64{group: uint64(prodPrice.Int64)}
+	}
+	if varPrice.Valid {
+		v.GroupPrices = map[string]uint64{group: uint64(varPrice.Int64)}
+	}
+
+	itm := CartItem{Product: prod, Amount: amount, TaxRate: TaxRate(prod.TaxClass), NextAmount: amount + 1, PrevAmount: amount - 1}
+	itm.Product.Price = prod.PriceFor(group)
+	itm.Product.GroupPrices = nil
+	if v.Id != 0 {
+		v.Product = prod.Id
+		itm.Product.Price = v.PriceOf(prod, group)
+		v.GroupPrices = nil
+		itm.Variant = &v
 	}
 
-	var avail_count uint64
-	err = rows.Scan(&avail_count)
+	return itm, nil
+}
+
+func FetchCart(session Session, member Member, database *sql.DB) ([]CartItem, error) {
+	sessId, memId := CartOwner(session)
+	rows, err := database.Query(cartItemQuery, member.Group, member.Group, sessId, memId)
 	if err != nil {
-		rows.Close()
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
+		return nil, err
 	}
 
+	cart := make([]CartItem, 0)
+	for rows.Next() {
+		itm, err := CartItemFromRow(rows, member.Group)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		cart = append(cart, itm)
+	}
 	rows.Close()
 
-	if avail_count+cur_count < count {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: no enough items in stock", 400)
-		return
+	return cart, nil
+}
+
+// Total to pay for the items in the cart, including tax but not shipping.
+func CartSum(cart []CartItem) uint64 {
+	rcpt := SumReceipt(Receipt{Order: Order{NetPrices: GlobalConfig.Tax.NetPrices}, Cart: cart})
+	return rcpt.Sum
+}
+
+// Variant in the optional "variant" field, 0 if there is none.
+func CartVariantFromForm(form url.Values) (int64, error) {
+	if form.Get("variant") == "" {
+		return 0, nil
 	}
 
-	_, err = tx.Exec("UPDATE products SET count = count + ? WHERE id = ?", cur_count, prodId)
+	varId, err := strconv.ParseInt(form.Get("variant"), 10, 64)
 	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		return 0, fmt.Errorf("Invalid variant")
+	}
+	return varId, nil
+}
+
+func AddToCart(form url.Values, member Member, session Session, w http.ResponseWriter, r *http.Request) {
+	// Product Id
+	ids, ok := form["id"]
+	if !ok || len(ids) != 1 || len(ids[0]) == 0 {
+		http.Error(w, "Missing or empty id", 400)
 		return
 	}
 
-	_, err = tx.Exec("UPDATE carts SET count = ? WHERE product = ? AND session = ?", count, prodId, session.Id)
+	id, err := strconv.ParseInt(ids[0], 10, 64)
 	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		http.Error(w, "Invalid id", 400)
 		return
 	}
 
-	_, err = tx.Exec("UPDATE products SET count = count - ? WHERE id = ?", count, prodId)
-	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+	// Count
+	counts, ok := form["count"]
+	if !ok || len(counts) != 1 || len(counts[0]) == 0 {
+		http.Error(w, "Missing or empty count", 400)
+		return
+	}
+
+	count, err := strconv.ParseUint(counts[0], 10, 64)
+	if err != nil || count == 0 {
+		http.Error(w, "Invalid count", 400)
 		return
 	}
 
-	err = tx.Commit()
+	varId, err := CartVariantFromForm(form)
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
+	DatabaseMutex.Lock()
+	err = AddCartItem(id, varId, count, session, Database)
 	DatabaseMutex.Unlock()
 
+	if err != nil {
+		http.Error(w, "Failed add to cart: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
 	http.Redirect(w, r, "/cart", 301)
 }
 
-func DeleteCartItem(prodId int64, member Member, session Session, w http.ResponseWriter, r *http.Request) {
+func GetCart(member Member, session Session, w http.ResponseWriter, r *http.Request) {
 	DatabaseMutex.Lock()
+	cart, err := FetchCart(session, member, Database)
+	DatabaseMutex.Unlock()
 
-	tx, err := Database.Begin()
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		http.Error(w, "Failed fetch cart: "+err.Error(), 500)
 		return
 	}
 
-	rows, err := tx.Query("SELECT count FROM carts WHERE product = ? AND session = ?", prodId, session.Id)
-	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
-	}
+	RenderTemplate(w, r, "cart", "", member, cart)
+}
 
-	if !rows.Next() {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: no such cart", 500)
+func PutCartItem(prodId int64, varId int64, member Member, session Session, w http.ResponseWriter, r *http.Request) {
+	// Amount
+	counts, ok := r.PostForm["count"]
+	if !ok || len(counts) != 1 || len(counts[0]) == 0 {
+		http.Error(w, "Missing or empty count", 400)
 		return
 	}
 
-	var cur_count uint
-	err = rows.Scan(&cur_count)
+	count, err := strconv.ParseUint(counts[0], 10, 64)
 	if err != nil {
-		rows.Close()
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		http.Error(w, "Invalid count", 400)
 		return
 	}
 
-	rows.Close()
+	DatabaseMutex.Lock()
+	err = SetCartItem(prodId, varId, count, session, Database)
+	DatabaseMutex.Unlock()
 
-	_, err = tx.Exec("UPDATE products SET count = count + ? WHERE id = ?", cur_count, prodId)
 	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		http.Error(w, "Failed add to cart: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	_, err = tx.Exec("DELETE FROM carts WHERE product = ? AND session = ?", prodId, session.Id)
-	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
-		return
-	}
+	http.Redirect(w, r, "/cart", 301)
+}
+
+func DeleteCartItem(prodId int64, varId int64, member Member, session Session, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	err := RemoveCartItem(prodId, varId, session, Database)
+	DatabaseMutex.Unlock()
 
-	err = tx.Commit()
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		http.Error(w, "Failed add to cart: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	DatabaseMutex.Unlock()
 	http.Redirect(w, r, "/cart", 301)
 }
 
@@ -398,10 +564,16 @@ func HandleCart(w http.ResponseWriter, r *http.Request) {
 				meth = meths[0]
 			}
 
+			varId, err := CartVariantFromForm(r.PostForm)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
 			if meth == "PUT" {
-				PutCartItem(prodId, mem, sess, w, r)
+				PutCartItem(prodId, varId, mem, sess, w, r)
 			} else if meth == "DELETE" {
-				DeleteCartItem(prodId, mem, sess, w, r)
+				DeleteCartItem(prodId, varId, mem, sess, w, r)
 			} else {
 				http.Error(w, "Method not supported", 405)
 			}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type Category struct {
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	Slug   string `json:"slug"`
+	Parent int64  `json:"parent"` // 0 for top level categories
+	Depth  int    `json:"depth"`  // Nesting level, filled by FetchCategories
+}
+
+// Name prefixed according to the nesting level, for use in <select> boxes.
+func (cat Category) Label() string {
+	return strings.Repeat("- ", cat.Depth) + cat.Name
+}
+
+func CategoryFromRow(rows *sql.Rows) (Category, error) {
+	var name, slug string
+	var id, parent int64
+
+	err := rows.Scan(&id, &name, &slug, &parent)
+	if err != nil {
+		return Category{}, err
+	}
+	return Category{Id: id, Name: name, Slug: slug, Parent: parent}, nil
+}
+
+func FetchCategory(id int64, database *sql.DB) (Category, error) {
+	rows, err := database.Query("SELECT * FROM categories WHERE id = ?", id)
+
+	if err != nil {
+		return Category{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return Category{}, errors.New("No such category")
+	}
+
+	cat, err := CategoryFromRow(rows)
+	rows.Close()
+
+	return cat, err
+}
+
+// Returns all categories in depth-first order, children following their
+// parent.
+func FetchCategories(database *sql.DB) ([]Category, error) {
+	rows, err := database.Query("SELECT * FROM categories ORDER BY name")
+
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int64][]Category)
+	for rows.Next() {
+		cat, err := CategoryFromRow(rows)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		children[cat.Parent] = append(children[cat.Parent], cat)
+	}
+	rows.Close()
+
+	cats := make([]Category, 0)
+
+	var walk func(int64, int)
+	walk = func(parent int64, depth int) {
+		for _, cat := range children[parent] {
+			cat.Depth = depth
+			cats = append(cats, cat)
+			walk(cat.Id, depth+1)
+		}
+	}
+	walk(0, 0)
+
+	return cats, nil
+}
+
+func InsertCategory(cat Category, database *sql.DB) (Category, error) {
+	res, err := database.Exec("INSERT INTO categories VALUES ( NULL, ?, ?, ? )", cat.Name, cat.Slug, cat.Parent)
+
+	if err != nil {
+		return Category{}, err
+	} else {
+		var id int64
+		id, err = res.LastInsertId()
+
+		if err != nil {
+			return Category{}, err
+		} else {
+			cat.Id = id
+			return cat, nil
+		}
+	}
+}
+
+func UpdateCategory(cat Category, database *sql.DB) (Category, error) {
+	res, err := database.Exec("UPDATE categories SET name = ?, slug = ?, parent = ? WHERE id = ?",
+		cat.Name, cat.Slug, cat.Parent, cat.Id)
+
+	if err != nil {
+		return Category{}, err
+	} else {
+		rows, err := res.RowsAffected()
+
+		if err != nil {
+			return Category{}, err
+		}
+
+		if rows == 0 {
+			return Category{}, fmt.Errorf("Category not found")
+		}
+
+		return cat, nil
+	}
+}
+
+// Checks whether parent is a valid parent category for cat, i.e. exists and
+// is neither cat itself nor one of its descendants.
+func CheckCategoryParent(cat Category, parent int64, database *sql.DB) error {
+	for parent != 0 {
+		if parent == cat.Id {
+			return fmt.Errorf("Category can't be its own parent")
+		}
+
+		p, err := FetchCategory(parent, database)
+		if err != nil {
+			return fmt.Errorf("Invalid parent category")
+		}
+
+		parent = p.Parent
+	}
+
+	return nil
+}
+
+func CategoryFromForm(form url.Values) (Category, error) {
+	var ok bool
+	var names, slugs, parents []string
+	var ret Category
+
+	// Name
+	names, ok = form["name"]
+	if !ok || len(names) != 1 || len(names[0]) == 0 {
+		return ret, fmt.Errorf("Missing or empty name")
+	}
+	name := names[0]
+
+	// Slug
+	slugs, ok = form["slug"]
+	if !ok || len(slugs) != 1 {
+		return ret, fmt.Errorf("Missing slug")
+	}
+	slug := slugs[0]
+
+	// Parent
+	var parent int64
+	parents, ok = form["parent"]
+	if ok && len(parents) == 1 && len(parents[0]) > 0 {
+		var err error
+		parent, err = strconv.ParseInt(parents[0], 10, 64)
+
+		if err != nil {
+			return ret, fmt.Errorf("Invalid parent")
+		}
+	}
+
+	ret = Category{
+		Id:     0,
+		Name:   name,
+		Slug:   slug,
+		Parent: parent,
+	}
+
+	return ret, nil
+}
+
+func GetCategories(mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	cats, err := FetchCategories(Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	meta := struct {
+		Categories []Category
+		Member     Member
+	}{
+		cats,
+		mem,
+	}
+
+	RenderTemplate(w, r, "categories/list", "", mem, meta)
+}
+
+func GetCategory(cat Category, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	rows, err := Database.Query("SELECT * FROM products WHERE category = ?", cat.Id)
+
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	prods := make([]Product, 0)
+	for rows.Next() {
+		prod, err := ProductFromRow(rows)
+
+		if err == nil {
+			prods = append(prods, prod)
+		}
+	}
+	rows.Close()
+
+	for i := range prods {
+		prods[i], err = FetchProductDetails(prods[i], Database)
+
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	cats, err := FetchCategories(Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	meta := struct {
+		Products   []Product
+		Category   Category
+		Categories []Category
+		Member     Member
+	}{
+		prods,
+		cat,
+		cats,
+		mem,
+	}
+
+	RenderTemplate(w, r, "products/list", cat.Name, mem, meta)
+}
+
+func PostNewCategory(mem Member, w http.ResponseWriter, r *http.Request) {
+	if !HasPermission(mem, "products.edit") {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to create category: "+err.Error(), 500)
+		return
+	}
+
+	cat, err := CategoryFromForm(r.PostForm)
+
+	if err != nil {
+		http.Error(w, "Failed to parse category form: "+err.Error(), 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	err = CheckCategoryParent(cat, cat.Parent, Database)
+
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to create category: "+err.Error(), 400)
+		return
+	}
+
+	cat, err = InsertCategory(cat, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to create category: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/categories/", 301)
+}
+
+func PutCategory(cat Category, mem Member, w http.ResponseWriter, r *http.Request) {
+	if !HasPermission(mem, "products.edit") {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	new_cat, err := CategoryFromForm(r.PostForm)
+
+	if err != nil {
+		http.Error(w, "Failed to parse category form: "+err.Error(), 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	new_cat.Id = cat.Id
+	err = CheckCategoryParent(new_cat, new_cat.Parent, Database)
+
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to update category: "+err.Error(), 400)
+		return
+	}
+
+	_, err = UpdateCategory(new_cat, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to update category: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/categories/", 301)
+}
+
+// Deletes the category. Its products and sub categories are moved to the
+// parent category.
+func DeleteCategory(cat Category, mem Member, w http.ResponseWriter, r *http.Request) {
+	if !HasPermission(mem, "products.edit") {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	tx, err := Database.Begin()
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to delete category: "+err.Error(), 500)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE products SET category = ? WHERE category = ?", cat.Parent, cat.Id)
+	if err != nil {
+		tx.Rollback()
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to delete category: "+err.Error(), 500)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE categories SET parent = ? WHERE parent = ?", cat.Parent, cat.Id)
+	if err != nil {
+		tx.Rollback()
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to delete category: "+err.Error(), 500)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM categories WHERE id = ?", cat.Id)
+	if err != nil {
+		tx.Rollback()
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to delete category: "+err.Error(), 500)
+		return
+	}
+
+	err = tx.Commit()
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to delete category: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/categories/", 301)
+}
+
+func HandleCategory(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleCategory() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if r.URL.Path == "/categories" || r.URL.Path == "/categories/" {
+		if r.Method == "POST" {
+			PostNewCategory(mem, w, r)
+		} else if r.Method == "GET" {
+			GetCategories(mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		catId, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/categories/"), 10, 64)
+
+		if err != nil {
+			http.Error(w, "Category not found: "+err.Error(), 404)
+			return
+		}
+
+		DatabaseMutex.Lock()
+		cat, err := FetchCategory(catId, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Category not found: "+err.Error(), 404)
+			return
+		}
+
+		if r.Method == "GET" {
+			GetCategory(cat, mem, w, r)
+		} else if r.Method == "POST" {
+			err := r.ParseForm()
+
+			if err != nil {
+				http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+				return
+			}
+
+			var meth string
+			meths, ok := r.PostForm["_method"]
+			if !ok || len(meths) != 1 || len(meths[0]) == 0 {
+				meth = "POST"
+			} else {
+				meth = meths[0]
+			}
+
+			if meth == "PUT" {
+				PutCategory(cat, mem, w, r)
+			} else if meth == "DELETE" {
+				DeleteCategory(cat, mem, w, r)
+			} else {
+				http.Error(w, "Not found", 404)
+			}
+		} else {
+			http.Error(w, "Not found", 404)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discount code entered on checkout. The discount only applies to the items
+// the code is restricted to and is stored with each order item, so taxes are
+// computed from the discounted prices.
+type Coupon struct {
+	Id         int64   `json:"id"`
+	Code       string  `json:"code"`       // Upper case, entered case-insensitively
+	Percent    uint64  `json:"percent"`    // Discount in percent, 0 for a fixed discount
+	Amount     uint64  `json:"amount"`     // Fixed discount in cents, unused if Percent is set
+	MinOrder   uint64  `json:"minOrder"`   // Smallest subtotal of the cart the code can be used for
+	MaxUses    uint64  `json:"maxUses"`    // 0 for no limit
+	Uses       uint64  `json:"uses"`       // Orders placed with the code, not counting cancelled ones
+	Expires    int64   `json:"expires"`    // Unix time, 0 if the code doesn't expire
+	Products   []int64 `json:"products"`   // Restricts the discount to these products...
+	Categories []int64 `json:"categories"` // ...and these categories including their subcategories
+}
+
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func formatIds(ids []int64) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(strs, " ")
+}
+
+func parseIds(s string) ([]int64, error) {
+	ids := make([]int64, 0)
+	for _, f := range strings.Fields(s) {
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func CouponFromRow(rows *sql.Rows) (Coupon, error) {
+	var c Coupon
+	var prods, cats string
+
+	err := rows.Scan(&c.Id, &c.Code, &c.Percent, &c.Amount, &c.MinOrder, &c.MaxUses, &c.Expires, &prods, &cats)
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	c.Products, err = parseIds(prods)
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	c.Categories, err = parseIds(cats)
+	return c, err
+}
+
+func fetchCouponUses(c Coupon, database *sql.DB) (Coupon, error) {
+	err := database.QueryRow("SELECT COUNT(*) FROM orders WHERE couponid = ? AND status <> 'cancelled'", c.Id).Scan(&c.Uses)
+	return c, err
+}
+
+func FetchCoupon(id int64, database *sql.DB) (Coupon, error) {
+	rows, err := database.Query("SELECT * FROM coupons WHERE id = ?", id)
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return Coupon{}, errors.New("No such coupon")
+	}
+
+	c, err := CouponFromRow(rows)
+	rows.Close()
+
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	return fetchCouponUses(c, database)
+}
+
+// Coupon with the code, 400 if there is none.
+func FetchCouponByCode(code string, database *sql.DB) (Coupon, error) {
+	rows, err := database.Query("SELECT * FROM coupons WHERE code = ?", NormalizeCouponCode(code))
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return Coupon{}, NewStatusError(400, "Unknown discount code '%s'", code)
+	}
+
+	c, err := CouponFromRow(rows)
+	rows.Close()
+
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	return fetchCouponUses(c, database)
+}
+
+func FetchCoupons(database *sql.DB) ([]Coupon, error) {
+	rows, err := database.Query("SELECT * FROM coupons ORDER BY code")
+	if err != nil {
+		return nil, err
+	}
+
+	coupons := make([]Coupon, 0)
+	for rows.Next() {
+		c, err := CouponFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		coupons = append(coupons, c)
+	}
+	rows.Close()
+
+	for i := range coupons {
+		coupons[i], err = fetchCouponUses(coupons[i], database)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return coupons, nil
+}
+
+// Fails if the code is empty or taken, the discount is missing or over 100%
+// or a product or category does not exist.
+func CheckCoupon(c Coupon, database *sql.DB) error {
+	if c.Code == "" || strings.ContainsAny(c.Code, " \t") {
+		return NewStatusError(400, "Code must not be empty or contain spaces")
+	}
+
+	if c.Percent > 100 {
+		return NewStatusError(400, "Discount can't be over 100%%")
+	}
+
+	if c.Percent == 0 && c.Amount == 0 {
+		return NewStatusError(400, "Missing discount")
+	}
+
+	var cnt int64
+	err := database.QueryRow("SELECT COUNT(*) FROM coupons WHERE code = ? AND id <> ?", c.Code, c.Id).Scan(&cnt)
+	if err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return NewStatusError(400, "Code '%s' exists already", c.Code)
+	}
+
+	for _, id := range c.Products {
+		if _, err := FetchProduct(id, database); err != nil {
+			return NewStatusError(400, "No such product: %d", id)
+		}
+	}
+
+	for _, id := range c.Categories {
+		if _, err := FetchCategory(id, database); err != nil {
+			return NewStatusError(400, "No such category: %d", id)
+		}
+	}
+
+	return nil
+}
+
+func InsertCoupon(c Coupon, database *sql.DB) (Coupon, error) {
+	res, err := database.Exec("INSERT INTO coupons VALUES ( NULL, ?, ?, ?, ?, ?, ?, ?, ? )", c.Code, c.Percent, c.Amount, c.MinOrder, c.MaxUses, c.Expires, formatIds(c.Products), formatIds(c.Categories))
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	c.Id, err = res.LastInsertId()
+	return c, err
+}
+
+func UpdateCoupon(c Coupon, database *sql.DB) error {
+	_, err := database.Exec("UPDATE coupons SET code = ?, percent = ?, amount = ?, minorder = ?, maxuses = ?, expires = ?, products = ?, categories = ? WHERE id = ?",
+		c.Code, c.Percent, c.Amount, c.MinOrder, c.MaxUses, c.Expires, formatIds(c.Products), formatIds(c.Categories), c.Id)
+	return err
+}
+
+// Deletes the coupon. Orders keep the code but no longer count as its uses,
+// so a new coupon reusing the id starts from zero.
+func RemoveCoupon(c Coupon, database *sql.DB) error {
+	_, err := database.Exec("UPDATE orders SET couponid = 0 WHERE couponid = ?", c.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM coupons WHERE id = ?", c.Id)
+	return err
+}
+
+// Whether the discount applies to the product. cats are all categories, used
+// to find the parents of the category of the product.
+func (c Coupon) Covers(prod Product, cats []Category) bool {
+	if len(c.Products) == 0 && len(c.Categories) == 0 {
+		return true
+	}
+
+	for _, id := range c.Products {
+		if id == prod.Id {
+			return true
+		}
+	}
+
+	parents := make(map[int64]int64)
+	for _, cat := range cats {
+		parents[cat.Id] = cat.Parent
+	}
+
+	// Categories can't be their own ancestors, but don't rely on it
+	for cat, depth := prod.Category, 0; cat != 0 && depth <= len(cats); cat, depth = parents[cat], depth+1 {
+		for _, id := range c.Categories {
+			if id == cat {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Sets the discount of the items in the cart the coupon applies to. Fails if
+// the coupon expired, was used up or doesn't apply to the cart.
+func ApplyCoupon(c Coupon, cart []CartItem, cats []Category) ([]CartItem, error) {
+	if c.Expires != 0 && c.Expires < time.Now().Unix() {
+		return nil, NewStatusError(400, "Discount code '%s' has expired", c.Code)
+	}
+
+	if c.MaxUses != 0 && c.Uses >= c.MaxUses {
+		return nil, NewStatusError(400, "Discount code '%s' has been used up", c.Code)
+	}
+
+	var subtotal, eligible uint64
+	for _, itm := range cart {
+		subtotal += itm.Product.Price * itm.Amount
+		if c.Covers(itm.Product, cats) {
+			eligible += itm.Product.Price * itm.Amount
+		}
+	}
+
+	if subtotal < c.MinOrder {
+		return nil, NewStatusError(400, "Discount code '%s' needs an order of at least %s EUR", c.Code, FormatMoney(c.MinOrder))
+	}
+
+	if eligible == 0 {
+		return nil, NewStatusError(400, "Discount code '%s' does not apply to any item in the cart", c.Code)
+	}
+
+	// Fixed discounts are split up in proportion to the price of the items,
+	// rounded down. The cents left over go to the first items, one each.
+	amount := c.Amount
+	if amount > eligible {
+		amount = eligible
+	}
+
+	ret := make([]CartItem, len(cart))
+	copy(ret, cart)
+
+	var given uint64
+	for i, itm := range ret {
+		if !c.Covers(itm.Product, cats) {
+			continue
+		}
+
+		line := itm.Product.Price * itm.Amount
+		if c.Percent != 0 {
+			ret[i].Discount = divRound(line*c.Percent, 100)
+		} else {
+			ret[i].Discount = amount * line / eligible
+			given += ret[i].Discount
+		}
+	}
+
+	// Less is left over than there are items with a price, and unless the
+	// whole cart is free every one of them got less than its price
+	for i, itm := range ret {
+		if c.Percent != 0 || given == amount {
+			break
+		}
+
+		if c.Covers(itm.Product, cats) && itm.Discount < itm.Product.Price*itm.Amount {
+			ret[i].Discount++
+			given++
+		}
+	}
+
+	return ret, nil
+}
+
+// Value of the field, 0 if it is empty.
+func optionalUint(form url.Values, field string) (uint64, error) {
+	v := strings.TrimSpace(form.Get(field))
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s", field)
+	}
+	return n, nil
+}
+
+// Fields are "code", "percent", "amount" in cents, "minorder", "maxuses",
+// "expires" as YYYY-MM-DD and "products" and "categories" with one id each.
+// Codes are valid through the day they expire.
+func CouponFromForm(form url.Values) (Coupon, error) {
+	var c Coupon
+	var err error
+
+	c.Code = NormalizeCouponCode(form.Get("code"))
+
+	c.Percent, err = optionalUint(form, "percent")
+	if err == nil {
+		c.Amount, err = optionalUint(form, "amount")
+	}
+	if err == nil {
+		c.MinOrder, err = optionalUint(form, "minorder")
+	}
+	if err == nil {
+		c.MaxUses, err = optionalUint(form, "maxuses")
+	}
+	if err != nil {
+		return Coupon{}, err
+	}
+
+	if v := strings.TrimSpace(form.Get("expires")); v != "" {
+		day, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return Coupon{}, fmt.Errorf("Invalid expiry date")
+		}
+		c.Expires = day.AddDate(0, 0, 1).Unix() - 1
+	}
+
+	c.Products, err = parseIds(strings.Join(form["products"], " "))
+	if err != nil {
+		return Coupon{}, fmt.Errorf("Invalid product")
+	}
+
+	c.Categories, err = parseIds(strings.Join(form["categories"], " "))
+	if err != nil {
+		return Coupon{}, fmt.Errorf("Invalid category")
+	}
+
+	return c, nil
+}
+
+// Id and name of all products, for choosing the ones a coupon applies to.
+func fetchProductNames(database *sql.DB) (map[int64]string, error) {
+	rows, err := database.Query("SELECT id,name FROM products")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var name string
+
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names[id] = name
+	}
+	rows.Close()
+
+	return names, nil
+}
+
+func GetCoupons(mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	coupons, err := FetchCoupons(Database)
+	var prods map[int64]string
+	var cats []Category
+	if err == nil {
+		prods, err = fetchProductNames(Database)
+	}
+	if err == nil {
+		cats, err = FetchCategories(Database)
+	}
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch coupons: "+err.Error(), 500)
+		return
+	}
+
+	meta := struct {
+		Coupons    []Coupon
+		Products   map[int64]string
+		Categories []Category
+	}{
+		coupons,
+		prods,
+		cats,
+	}
+
+	RenderTemplate(w, r, "coupons/list", "", mem, meta)
+}
+
+func PostNewCoupon(mem Member, w http.ResponseWriter, r *http.Request) {
+	c, err := CouponFromForm(r.PostForm)
+	if err != nil {
+		http.Error(w, "Failed to create coupon: "+err.Error(), 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	err = CheckCoupon(c, Database)
+	if err == nil {
+		_, err = InsertCoupon(c, Database)
+	}
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to create coupon: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/coupons/", 301)
+}
+
+func DeleteCoupon(c Coupon, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	err := RemoveCoupon(c, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to delete coupon: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/coupons/", 301)
+}
+
+func HandleCoupon(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleCoupon() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if !HasPermission(mem, "coupons.manage") {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	meth := r.Method
+	if r.Method == "POST" {
+		err := r.ParseForm()
+
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		meths, ok := r.PostForm["_method"]
+		if ok && len(meths) == 1 && len(meths[0]) > 0 {
+			meth = meths[0]
+		}
+	}
+
+	if r.URL.Path == "/coupons" || r.URL.Path == "/coupons/" {
+		if meth == "GET" {
+			GetCoupons(mem, w, r)
+		} else if meth == "POST" {
+			PostNewCoupon(mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		couponId, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/coupons/"), 10, 64)
+		if err != nil {
+			http.Error(w, "Coupon not found: "+err.Error(), 404)
+			return
+		}
+
+		DatabaseMutex.Lock()
+		c, err := FetchCoupon(couponId, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Coupon not found: "+err.Error(), 404)
+			return
+		}
+
+		if meth == "DELETE" {
+			DeleteCoupon(c, mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyCoupon(t *testing.T) {
+	// Stickers and T-Shirts are below Merchandise, Books are not
+	cats := []Category{
+		{Id: 1, Name: "Merchandise"},
+		{Id: 2, Name: "Stickers", Parent: 1},
+		{Id: 3, Name: "T-Shirts", Parent: 1},
+		{Id: 4, Name: "Books"},
+	}
+
+	item := func(id int64, cat int64, price uint64, amount uint64) CartItem {
+		return CartItem{Product: Product{Id: id, Category: cat, Price: price}, Amount: amount}
+	}
+
+	tests := []struct {
+		name      string
+		coupon    Coupon
+		cart      []CartItem
+		discounts []uint64
+	}{
+		{
+			"percent",
+			Coupon{Percent: 10},
+			[]CartItem{item(1, 0, 1000, 1), item(2, 0, 333, 3)},
+			[]uint64{100, 100},
+		},
+		{
+			"percent, rounded",
+			Coupon{Percent: 15},
+			[]CartItem{item(1, 0, 10, 1), item(2, 0, 3, 1), item(3, 0, 1, 1)},
+			[]uint64{2, 0, 0},
+		},
+		{
+			"percent, whole cart free",
+			Coupon{Percent: 100},
+			[]CartItem{item(1, 0, 999, 2), item(2, 0, 1, 1)},
+			[]uint64{1998, 1},
+		},
+		{
+			"percent, restricted to product",
+			Coupon{Percent: 50, Products: []int64{2}},
+			[]CartItem{item(1, 0, 1000, 1), item(2, 0, 300, 2)},
+			[]uint64{0, 300},
+		},
+		{
+			"percent, restricted to category",
+			Coupon{Percent: 50, Categories: []int64{1}},
+			[]CartItem{item(1, 2, 100, 1), item(2, 3, 2000, 1), item(3, 4, 1500, 1), item(4, 0, 500, 1)},
+			[]uint64{50, 1000, 0, 0},
+		},
+		{
+			"percent, restricted to product or category",
+			Coupon{Percent: 50, Products: []int64{3}, Categories: []int64{3}},
+			[]CartItem{item(1, 2, 100, 1), item(2, 3, 2000, 1), item(3, 4, 1500, 1)},
+			[]uint64{0, 1000, 750},
+		},
+		{
+			"fixed",
+			Coupon{Amount: 500},
+			[]CartItem{item(1, 0, 1000, 1), item(2, 0, 500, 2)},
+			[]uint64{250, 250},
+		},
+		{
+			"fixed, in proportion to the price",
+			Coupon{Amount: 600},
+			[]CartItem{item(1, 0, 1000, 1), item(2, 0, 500, 1), item(3, 0, 1500, 1)},
+			[]uint64{200, 100, 300},
+		},
+		{
+			"fixed, remainder",
+			Coupon{Amount: 10},
+			[]CartItem{item(1, 0, 100, 1), item(2, 0, 100, 1), item(3, 0, 100, 1)},
+			[]uint64{4, 3, 3},
+		},
+		{
+			// 100 * 99/199 = 49.7, the cheap item can't take the remainder
+			"fixed, remainder larger than the last item",
+			Coupon{Amount: 100},
+			[]CartItem{item(1, 0, 99, 1), item(2, 0, 99, 1), item(3, 0, 1, 1)},
+			[]uint64{50, 50, 0},
+		},
+		{
+			"fixed, remainder skips free items",
+			Coupon{Amount: 101},
+			[]CartItem{item(1, 0, 0, 1), item(2, 0, 100, 1), item(3, 0, 100, 1)},
+			[]uint64{0, 51, 50},
+		},
+		{
+			"fixed, remainder skips items not covered",
+			Coupon{Amount: 5, Categories: []int64{4}},
+			[]CartItem{item(1, 2, 100, 1), item(2, 4, 100, 1), item(3, 4, 100, 1)},
+			[]uint64{0, 3, 2},
+		},
+		{
+			"fixed, more than the items cost",
+			Coupon{Amount: 5000, Products: []int64{1, 2}},
+			[]CartItem{item(1, 0, 1000, 1), item(2, 0, 250, 2), item(3, 0, 700, 1)},
+			[]uint64{1000, 500, 0},
+		},
+		{
+			"minimum order counts all items",
+			Coupon{Amount: 100, MinOrder: 2000, Products: []int64{1}},
+			[]CartItem{item(1, 0, 1000, 1), item(2, 0, 1000, 1)},
+			[]uint64{100, 0},
+		},
+		{
+			"not expired or used up yet",
+			Coupon{Percent: 10, Expires: time.Now().Unix() + 3600, MaxUses: 2, Uses: 1},
+			[]CartItem{item(1, 0, 1000, 1)},
+			[]uint64{100},
+		},
+	}
+
+	for _, tt := range tests {
+		cart, err := ApplyCoupon(tt.coupon, tt.cart, cats)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		discounts := make([]uint64, len(cart))
+		for i, itm := range cart {
+			discounts[i] = itm.Discount
+		}
+		if !reflect.DeepEqual(discounts, tt.discounts) {
+			t.Errorf("%s: discounts %v, want %v", tt.name, discounts, tt.discounts)
+		}
+
+		for _, itm := range tt.cart {
+			if itm.Discount != 0 {
+				t.Errorf("%s: cart passed in was changed", tt.name)
+			}
+		}
+	}
+}
+
+func TestApplyCouponErrors(t *testing.T) {
+	cats := []Category{{Id: 1, Name: "Stickers"}}
+	cart := []CartItem{
+		{Product: Product{Id: 1, Category: 1, Price: 1000}, Amount: 1},
+		{Product: Product{Id: 2, Price: 0}, Amount: 3},
+	}
+
+	tests := []struct {
+		name   string
+		coupon Coupon
+	}{
+		{"expired", Coupon{Percent: 10, Expires: time.Now().Unix() - 1}},
+		{"used up", Coupon{Percent: 10, MaxUses: 2, Uses: 2}},
+		{"minimum order", Coupon{Percent: 10, MinOrder: 1001}},
+		{"other product", Coupon{Percent: 10, Products: []int64{3}}},
+		{"other category", Coupon{Percent: 10, Categories: []int64{2}}},
+		{"free items only", Coupon{Amount: 100, Products: []int64{2}}},
+	}
+
+	for _, tt := range tests {
+		_, err := ApplyCoupon(tt.coupon, cart, cats)
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		} else if code := ErrorStatus(err); code != 400 {
+			t.Errorf("%s: status %d, want 400", tt.name, code)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey int
+
+const (
+	sessionContextKey contextKey = iota
+	tokenContextKey
+)
+
+// Name of the form field and header carrying the CSRF token
+const (
+	CSRFField  = "csrf"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// Paths served without a session
+var sessionlessPrefixes = []string{"/static/", "/images/"}
+
+// Session stored in the request context by SessionHandler.
+func RequestSession(r *http.Request) (Session, bool) {
+	sess, ok := r.Context().Value(sessionContextKey).(Session)
+	return sess, ok
+}
+
+// API token the request was authenticated with, if any.
+func RequestAPIToken(r *http.Request) (APIToken, bool) {
+	tok, ok := r.Context().Value(tokenContextKey).(APIToken)
+	return tok, ok
+}
+
+func ValidCSRFToken(sess Session, token string) bool {
+	return sess.CSRF != "" && subtle.ConstantTimeCompare([]byte(sess.CSRF), []byte(token)) == 1
+}
+
+// Hidden form field with the CSRF token of the session. Every form posting to
+// the shop must include it.
+func CSRFFormField(sess Session) template.HTML {
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, CSRFField, template.HTMLEscapeString(sess.CSRF)))
+}
+
+func sessionError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if IsAPIRequest(r) {
+		WriteAPIError(w, code, msg)
+	} else {
+		http.Error(w, msg, code)
+	}
+}
+
+// Fetches the session of every request and rejects all requests except GET
+// and HEAD that do not carry the CSRF token of the session, either in the
+// "csrf" form field or the X-CSRF-Token header.
+//
+// Requests with an "Authorization: Bearer" header are authenticated by the
+// API token instead. They get a session of the token's member that is not
+// stored and need no CSRF token, as browsers never send the header on their
+// own.
+func SessionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range sessionlessPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			secret := strings.TrimPrefix(auth, "Bearer ")
+			if secret == auth || secret == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				sessionError(w, r, "Unsupported authorization scheme", 401)
+				return
+			}
+
+			DatabaseMutex.Lock()
+			tok, err := AuthenticateAPIToken(secret, Database)
+			DatabaseMutex.Unlock()
+
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				sessionError(w, r, "Invalid API token", 401)
+				return
+			}
+
+			if !tok.Allows(r) {
+				sessionError(w, r, "API token lacks the scope for this request", 403)
+				return
+			}
+
+			now := time.Now().Unix()
+			sess := Session{0, "", tok.Member, now, ClientUserAgent(r), ClientIP(r), now, ""}
+
+			ctx := context.WithValue(r.Context(), sessionContextKey, sess)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenContextKey, tok)))
+			return
+		}
+
+		DatabaseMutex.Lock()
+		sess := FetchOrCreateSession(w, r, Database)
+		DatabaseMutex.Unlock()
+
+		r = r.WithContext(context.WithValue(r.Context(), sessionContextKey, sess))
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			token := r.Header.Get(CSRFHeader)
+
+			if token == "" {
+				err := ParseAnyForm(r)
+				if err != nil {
+					sessionError(w, r, "Failed to parse form data: "+err.Error(), 400)
+					return
+				}
+
+				token = r.PostForm.Get(CSRFField)
+			}
+
+			if !ValidCSRFToken(sess, token) {
+				sessionError(w, r, "Invalid or missing CSRF token, please reload the page and try again", 403)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
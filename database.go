@@ -2,32 +2,270 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"log"
+	"os"
 	"sync"
+	"time"
 )
 
 var Database *sql.DB
 var DatabaseMutex sync.Mutex
 
-func InitializeDatabase() error {
+// A single step in the evolution of the database schema. Migrations are
+// applied in order of their version and are never changed once released,
+// new schema changes get a new migration appended to Migrations.
+type Migration struct {
+	Version     int64
+	Description string
+	Statements  []string
+}
+
+var Migrations = []Migration{
+	{1, "Initial schema", []string{
+		"CREATE TABLE IF NOT EXISTS products (id INTEGER PRIMARY KEY, name STRING, slug STRING, description STRING, price INTEGER, count INTEGER)",
+		"CREATE TABLE IF NOT EXISTS members (id INTEGER PRIMARY KEY, name STRING UNIQUE, email STRING, passwd STRING, grp STRING)",
+		"CREATE TABLE IF NOT EXISTS sessions (id STRING PRIMARY KEY, member INTEGER, lastseen INTEGER)",
+		"CREATE TABLE IF NOT EXISTS carts (product INTEGER, session STRING, count INTEGER)",
+		"CREATE TABLE IF NOT EXISTS orders (id INTEGER PRIMARY KEY, date INTEGER, member INTEGER, status STRING, uuid STRING)",
+		"CREATE TABLE IF NOT EXISTS order_items (orderid INTEGER, product INTEGER, count UNSIGNED INTEGER)",
+		// Anonymous sessions point to member 0
+		"INSERT OR IGNORE INTO members VALUES ( 0, '', '', '', 'customer' )",
+	}},
+	{2, "Product categories", []string{
+		"CREATE TABLE categories (id INTEGER PRIMARY KEY, name STRING, slug STRING, parent INTEGER)",
+		"ALTER TABLE products ADD COLUMN category INTEGER NOT NULL DEFAULT 0",
+	}},
+	{3, "Product images", []string{
+		"CREATE TABLE product_images (id INTEGER PRIMARY KEY, product INTEGER, filename STRING)",
+	}},
+	{4, "Cart reservations instead of decrementing stock", []string{
+		"ALTER TABLE carts ADD COLUMN reserved INTEGER NOT NULL DEFAULT 0",
+		"UPDATE carts SET reserved = IFNULL((SELECT lastseen FROM sessions WHERE sessions.id = carts.session), 0)",
+		"UPDATE products SET count = count + IFNULL((SELECT SUM(count) FROM carts WHERE carts.product = products.id), 0)",
+	}},
+	{5, "Order status history", []string{
+		"CREATE TABLE order_status_history (orderid INTEGER, status STRING, date INTEGER)",
+		"INSERT INTO order_status_history SELECT id, 'new', date FROM orders",
+		"INSERT INTO order_status_history SELECT id, status, date FROM orders WHERE status <> 'new'",
+	}},
+	{6, "Password reset tokens", []string{
+		"CREATE TABLE password_resets (token STRING PRIMARY KEY, member INTEGER, expires INTEGER, used INTEGER NOT NULL DEFAULT 0)",
+	}},
+	{7, "Session user agent, address and creation time", []string{
+		"ALTER TABLE sessions ADD COLUMN useragent STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE sessions ADD COLUMN ip STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE sessions ADD COLUMN created INTEGER NOT NULL DEFAULT 0",
+		"UPDATE sessions SET created = lastseen",
+	}},
+	{8, "Session CSRF tokens", []string{
+		"ALTER TABLE sessions ADD COLUMN csrf STRING NOT NULL DEFAULT ''",
+		"UPDATE sessions SET csrf = lower(hex(randomblob(32)))",
+	}},
+	{9, "API tokens", []string{
+		"CREATE TABLE api_tokens (id INTEGER PRIMARY KEY, member INTEGER, name STRING, token STRING UNIQUE, scopes STRING, created INTEGER, lastused INTEGER NOT NULL DEFAULT 0)",
+	}},
+	{10, "Imported bank transactions", []string{
+		"CREATE TABLE bank_transactions (id INTEGER PRIMARY KEY, hash STRING UNIQUE, date INTEGER, amount INTEGER, reference STRING, counterparty STRING, bankref STRING, orderid INTEGER NOT NULL DEFAULT 0, result STRING, reviewed INTEGER NOT NULL DEFAULT 0, imported INTEGER)",
+	}},
+	{11, "Invoices", []string{
+		"CREATE TABLE invoices (number INTEGER PRIMARY KEY, orderid INTEGER UNIQUE, date INTEGER)",
+	}},
+	{12, "Snapshot of product name, price and tax rate on order items", []string{
+		"ALTER TABLE order_items ADD COLUMN name STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE order_items ADD COLUMN price INTEGER NOT NULL DEFAULT 0",
+		// Hundredths of a percent
+		"ALTER TABLE order_items ADD COLUMN taxrate INTEGER NOT NULL DEFAULT 0",
+		// Best we can do for existing orders is the current name and price
+		"UPDATE order_items SET name = (SELECT name FROM products WHERE products.id = order_items.product), price = (SELECT price FROM products WHERE products.id = order_items.product) WHERE product IN (SELECT id FROM products)",
+	}},
+	{13, "Tax classes", []string{
+		"ALTER TABLE products ADD COLUMN taxclass STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN netprices INTEGER NOT NULL DEFAULT 0",
+	}},
+	{14, "Shipping methods", []string{
+		// In grams
+		"ALTER TABLE products ADD COLUMN weight INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE orders ADD COLUMN shipping STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN shippingname STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN shippingprice INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE orders ADD COLUMN shippingtax INTEGER NOT NULL DEFAULT 0",
+	}},
+	{15, "Addresses", []string{
+		"CREATE TABLE addresses (id INTEGER PRIMARY KEY, member INTEGER, name STRING, extra STRING, street STRING, zip STRING, city STRING, country STRING)",
+		// Kind is "shipping" or "billing"
+		"CREATE TABLE order_addresses (orderid INTEGER, kind STRING, name STRING, extra STRING, street STRING, zip STRING, city STRING, country STRING, UNIQUE(orderid, kind))",
+	}},
+	{16, "Guest checkout", []string{
+		"ALTER TABLE orders ADD COLUMN email STRING NOT NULL DEFAULT ''",
+	}},
+	{17, "Product variants", []string{
+		"CREATE TABLE variants (id INTEGER PRIMARY KEY, product INTEGER, name STRING, sku STRING, price INTEGER, count INTEGER)",
+		// 0 for products without variants
+		"ALTER TABLE carts ADD COLUMN variant INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE order_items ADD COLUMN variant INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE order_items ADD COLUMN variantname STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE order_items ADD COLUMN sku STRING NOT NULL DEFAULT ''",
+	}},
+	{18, "Discount codes", []string{
+		"CREATE TABLE coupons (id INTEGER PRIMARY KEY, code STRING, percent INTEGER, amount INTEGER, minorder INTEGER, maxuses INTEGER, expires INTEGER, products STRING, categories STRING)",
+		"ALTER TABLE orders ADD COLUMN coupon STRING NOT NULL DEFAULT ''",
+		"ALTER TABLE order_items ADD COLUMN discount INTEGER NOT NULL DEFAULT 0",
+	}},
+	{19, "Member group prices", []string{
+		"CREATE TABLE product_prices (product INTEGER, grp STRING, price INTEGER)",
+	}},
+	{20, "Member carts", []string{
+		"ALTER TABLE carts ADD COLUMN member INTEGER NOT NULL DEFAULT 0",
+		"INSERT INTO carts SELECT carts.product, '', SUM(carts.count), MAX(carts.reserved), carts.variant, sessions.member FROM carts JOIN sessions ON sessions.id = carts.session WHERE sessions.member <> 0 GROUP BY sessions.member, carts.product, carts.variant",
+		"DELETE FROM carts WHERE session IN (SELECT id FROM sessions WHERE member <> 0)",
+	}},
+	{21, "Guest order claims", []string{
+		"CREATE TABLE order_claims (token STRING PRIMARY KEY, orderid INTEGER, member INTEGER, expires INTEGER)",
+	}},
+	{22, "Coupon ids on orders", []string{
+		"ALTER TABLE orders ADD COLUMN couponid INTEGER NOT NULL DEFAULT 0",
+		"UPDATE orders SET couponid = IFNULL((SELECT id FROM coupons WHERE coupons.code = orders.coupon), 0) WHERE coupon <> ''",
+	}},
+	{23, "Restocked orders", []string{
+		"ALTER TABLE orders ADD COLUMN restocked INTEGER NOT NULL DEFAULT 0",
+		"UPDATE orders SET restocked = 1 WHERE status = 'cancelled'",
+	}},
+	{24, "Member group prices of variants", []string{
+		"CREATE TABLE variant_prices (variant INTEGER, grp STRING, price INTEGER)",
+	}},
+}
+
+func InitializeDatabase(dryRun bool) error {
 	var err error
 
+	// Dry runs only look at the database, opening it read-only makes sure of it
+	if dryRun {
+		Database, err = sql.Open("sqlite3", "file:"+GlobalConfig.Database+"?mode=ro")
+		if err != nil {
+			return err
+		}
+		return PrintPendingMigrations(Database, os.Stdout)
+	}
+
 	Database, err = sql.Open("sqlite3", GlobalConfig.Database)
 
 	if err != nil {
 		return err
 	}
 
-	InitializeSchema()
+	return MigrateSchema(Database)
+}
+
+// Latest migration applied to the database, 0 if there is no schema_version
+// table yet. MigrateSchema creates it with the first migration.
+func SchemaVersion(database *sql.DB) (int64, error) {
+	var tables int64
+	err := database.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+
+	rows, err := database.Query("SELECT IFNULL(MAX(version), 0) FROM schema_version")
+	if err != nil {
+		return 0, err
+	}
+
+	var version int64
+	if rows.Next() {
+		err = rows.Scan(&version)
+	}
+	rows.Close()
+
+	return version, err
+}
+
+func PendingMigrations(database *sql.DB) ([]Migration, error) {
+	version, err := SchemaVersion(database)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+	last := int64(0)
+	for _, m := range Migrations {
+		if m.Version <= last {
+			return nil, fmt.Errorf("Migration %d is out of order", m.Version)
+		}
+		last = m.Version
+
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+func PrintPendingMigrations(database *sql.DB, w io.Writer) error {
+	pending, err := PendingMigrations(database)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "Database schema is up to date")
+		return nil
+	}
+
+	for _, m := range pending {
+		fmt.Fprintf(w, "-- Migration %d: %s\n", m.Version, m.Description)
+		for _, stmt := range m.Statements {
+			fmt.Fprintln(w, stmt+";")
+		}
+	}
 
 	return nil
 }
 
-func InitializeSchema() {
-	Database.Exec("CREATE TABLE products (id INTEGER PRIMARY KEY, name STRING, slug STRING, description STRING, price INTEGER, count INTEGER)")
-	Database.Exec("CREATE TABLE members (id INTEGER PRIMARY KEY, name STRING UNIQUE, email STRING, passwd STRING, grp STRING)")
-	Database.Exec("CREATE TABLE sessions (id STRING PRIMARY KEY, member INTEGER, lastseen INTEGER)")
-	Database.Exec("CREATE TABLE carts (product INTEGER, session STRING, count INTEGER)")
-	Database.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, date INTEGER, member INTEGER, status STRING, uuid STRING)")
-	Database.Exec("CREATE TABLE order_items (orderid INTEGER, product INTEGER, count UNSIGNED INTEGER)")
+func MigrateSchema(database *sql.DB) error {
+	pending, err := PendingMigrations(database)
+	if err != nil {
+		return err
+	}
+
+	for i, m := range pending {
+		log.Printf("Apply migration %d: %s", m.Version, m.Description)
+
+		tx, err := database.Begin()
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, description STRING, applied INTEGER)")
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed: %s", m.Version, err.Error())
+			}
+		}
+
+		for _, stmt := range m.Statements {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed: %s (%s)", m.Version, err.Error(), stmt)
+			}
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_version VALUES ( ?, ?, ? )", m.Version, m.Description, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d failed: %s", m.Version, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("Migration %d failed: %s", m.Version, err.Error())
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestMigrateSchema(t *testing.T) {
+	database, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	// Every connection would get its own in-memory database
+	database.SetMaxOpenConns(1)
+
+	var out strings.Builder
+	err = PrintPendingMigrations(database, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "-- Migration ") != len(Migrations) {
+		t.Errorf("Not all migrations pending on an empty database:\n%s", out.String())
+	}
+
+	var tables int64
+	err = database.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+	if err != nil || tables != 0 {
+		t.Errorf("Dry run created %d tables, %v", tables, err)
+	}
+
+	err = MigrateSchema(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := SchemaVersion(database)
+	if err != nil || version != Migrations[len(Migrations)-1].Version {
+		t.Errorf("Schema version %d, %v after migrating", version, err)
+	}
+
+	pending, err := PendingMigrations(database)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("%d migrations pending after migrating, %v", len(pending), err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Group of members, e.g. paying members of the association who get lower
+// prices or volunteers helping with orders. "admin" and "customer" always
+// exist, more can be configured. Groups double as roles, Permissions are the
+// names of what their members may do besides shopping.
+type MemberGroup struct {
+	Id          string
+	Name        string
+	Permissions []string
+}
+
+var builtinGroups = []MemberGroup{{"admin", "Administrator", nil}, {"customer", "Kunde", nil}}
+
+func CheckGroupConfiguration(groups []MemberGroup) error {
+	ids := make(map[string]bool)
+	for _, g := range builtinGroups {
+		ids[g.Id] = true
+	}
+
+	for _, g := range groups {
+		if g.Id == "" || g.Name == "" || strings.ContainsAny(g.Id, " \t") {
+			return errors.New("Member groups need an id without spaces and a name")
+		}
+
+		if ids[g.Id] {
+			return errors.New("Duplicate member group '" + g.Id + "'")
+		}
+		ids[g.Id] = true
+
+		err := CheckPermissions(g.Permissions)
+		if err != nil {
+			return fmt.Errorf("Member group '%s': %s", g.Id, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Built-in groups followed by the configured ones.
+func MemberGroups() []MemberGroup {
+	return append(append([]MemberGroup{}, builtinGroups...), GlobalConfig.Groups...)
+}
+
+func IsMemberGroup(id string) bool {
+	for _, g := range MemberGroups() {
+		if g.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of the group, its id if it is not configured anymore.
+func GroupName(id string) string {
+	for _, g := range MemberGroups() {
+		if g.Id == id {
+			return g.Name
+		}
+	}
+	return id
+}
+
+// Price for members of the group.
+func (prod Product) PriceFor(group string) uint64 {
+	if price, ok := prod.GroupPrices[group]; ok {
+		return price
+	}
+	return prod.Price
+}
+
+// Prices of the product for groups that don't pay the regular price.
+func FetchGroupPrices(prodId int64, database *sql.DB) (map[string]uint64, error) {
+	rows, err := database.Query("SELECT grp,price FROM product_prices WHERE product = ?", prodId)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string]uint64)
+	for rows.Next() {
+		var grp string
+		var price uint64
+
+		err = rows.Scan(&grp, &price)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		prices[grp] = price
+	}
+	rows.Close()
+
+	return prices, nil
+}
+
+// Replaces the group prices of the product with those in prod.GroupPrices.
+func SaveGroupPrices(prod Product, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM product_prices WHERE product = ?", prod.Id)
+	if err != nil {
+		return err
+	}
+
+	for grp, price := range prod.GroupPrices {
+		_, err = database.Exec("INSERT INTO product_prices VALUES ( ?, ?, ? )", prod.Id, grp, price)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prices of the variant for groups, overriding those of its product.
+func FetchVariantGroupPrices(varId int64, database *sql.DB) (map[string]uint64, error) {
+	rows, err := database.Query("SELECT grp,price FROM variant_prices WHERE variant = ?", varId)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string]uint64)
+	for rows.Next() {
+		var grp string
+		var price uint64
+
+		err = rows.Scan(&grp, &price)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		prices[grp] = price
+	}
+	rows.Close()
+
+	return prices, nil
+}
+
+// Replaces the group prices of the variant with those in v.GroupPrices.
+func SaveVariantGroupPrices(v Variant, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM variant_prices WHERE variant = ?", v.Id)
+	if err != nil {
+		return err
+	}
+
+	for grp, price := range v.GroupPrices {
+		_, err = database.Exec("INSERT INTO variant_prices VALUES ( ?, ?, ? )", v.Id, grp, price)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func CheckGroupPrices(prices map[string]uint64) error {
+	for grp := range prices {
+		if !IsMemberGroup(grp) {
+			return NewStatusError(400, "Unknown member group '%s'", grp)
+		}
+	}
+	return nil
+}
+
+// Group prices in the fields "price_<group>". Empty fields mean the group pays
+// the regular price.
+func GroupPricesFromForm(form url.Values) (map[string]uint64, error) {
+	prices := make(map[string]uint64)
+
+	for _, g := range MemberGroups() {
+		v := strings.TrimSpace(form.Get("price_" + g.Id))
+		if v == "" {
+			continue
+		}
+
+		price, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid price for %s", g.Name)
+		}
+		prices[g.Id] = price
+	}
+
+	return prices, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Guest orders can be looked up by their UUID. It is only told to the
+// customer, so guests use it to follow their orders and to attach them to an
+// account. Members whose email address differs from the one of the order
+// have to confirm with a link mailed to the order's address first.
+
+// Confirmation links for attaching guest orders are valid for one day
+const OrderClaimLifetime int64 = 60 * 60 * 24
+
+type OrderClaim struct {
+	Receipt Receipt
+	Member  Member
+	Token   string
+	Expires int64 // Unix time
+}
+
+// Whether the member may attach the guest order without confirmation.
+func OwnsOrderEMail(mem Member, ord Order) bool {
+	return mem.Id != 0 && ord.EMail != "" && strings.EqualFold(mem.EMail, ord.EMail)
+}
+
+// Attaches the guest order to the member. Its email address is kept.
+func ClaimGuestOrder(ordId int64, memId int64, database *sql.DB) error {
+	res, err := database.Exec("UPDATE orders SET member = ? WHERE id = ? AND member = 0", memId, ordId)
+	if err != nil {
+		return err
+	}
+
+	cnt, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt != 1 {
+		return NewStatusError(400, "Order belongs to a member already")
+	}
+
+	_, err = database.Exec("DELETE FROM order_claims WHERE orderid = ?", ordId)
+	return err
+}
+
+func NewOrderClaim(rcpt Receipt, mem Member, database *sql.DB) (OrderClaim, error) {
+	_, err := database.Exec("DELETE FROM order_claims WHERE expires < ?", time.Now().Unix())
+	if err != nil {
+		return OrderClaim{}, err
+	}
+
+	tok := make([]byte, 32)
+	_, err = rand.Read(tok)
+	if err != nil {
+		return OrderClaim{}, err
+	}
+
+	claim := OrderClaim{rcpt, mem, hex.EncodeToString(tok), time.Now().Unix() + OrderClaimLifetime}
+	_, err = database.Exec("INSERT INTO order_claims VALUES ( ?, ?, ?, ? )", HashToken(claim.Token), rcpt.Order.Id, mem.Id, claim.Expires)
+	if err != nil {
+		return OrderClaim{}, err
+	}
+
+	return claim, nil
+}
+
+// Attaches the order to the member if the token was issued for both and is
+// not expired.
+func UseOrderClaim(token string, ordId int64, mem Member, database *sql.DB) error {
+	var memId int64
+	err := database.QueryRow("SELECT member FROM order_claims WHERE token = ? AND orderid = ? AND expires >= ?", HashToken(token), ordId, time.Now().Unix()).Scan(&memId)
+	if err == sql.ErrNoRows {
+		return NewStatusError(400, "Invalid or expired link")
+	} else if err != nil {
+		return err
+	}
+
+	if memId != mem.Id {
+		return NewStatusError(403, "Please login with the account that requested the link")
+	}
+
+	return ClaimGuestOrder(ordId, mem.Id, database)
+}
+
+// Shows the order. sent tells that a confirmation link was just mailed.
+func GetOrderLookup(rcpt Receipt, mem Member, sent bool, w http.ResponseWriter, r *http.Request) {
+	meta := struct {
+		Receipt   Receipt
+		Guest     bool // Placed by a guest, can be attached to an account
+		Member    Member
+		Confirm   bool   // Attaching needs confirmation by mail
+		Claim     string // Token of a confirmation link
+		ClaimSent bool
+	}{
+		rcpt,
+		rcpt.Order.Member == 0,
+		mem,
+		!OwnsOrderEMail(mem, rcpt.Order),
+		r.URL.Query().Get("claim"),
+		sent,
+	}
+
+	RenderTemplate(w, r, "orders/lookup", "", mem, meta)
+}
+
+// Attaches the guest order to a new account registered with its email
+// address, to a logged in member with the same address or, with a token from
+// a confirmation link, to the member who requested it. Other members get the
+// link mailed to the address of the order.
+func PostOrderLookup(rcpt Receipt, sess Session, mem Member, w http.ResponseWriter, r *http.Request) {
+	if rcpt.Order.Member != 0 {
+		http.Error(w, "Order belongs to a member already", 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	if claim := r.PostForm.Get("claim"); claim != "" {
+		err := UseOrderClaim(claim, rcpt.Order.Id, mem, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Failed to attach order: "+err.Error(), ErrorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/orders/my", 301)
+		return
+	}
+
+	if mem.Id == 0 {
+		form := r.PostForm
+		form.Set("email", rcpt.Order.EMail)
+
+		new_mem, err := MemberFromForm(form)
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, "Failed create member: "+err.Error(), 400)
+			return
+		}
+
+		mem, err = RegisterMember(new_mem, sess, Database)
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, "Failed create member: "+err.Error(), ErrorStatus(err))
+			return
+		}
+	}
+
+	if !OwnsOrderEMail(mem, rcpt.Order) {
+		claim, err := NewOrderClaim(rcpt, mem, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Failed to attach order: "+err.Error(), 500)
+			return
+		}
+
+		SendMail(rcpt.Order.EMail, "mails/claim", claim)
+
+		GetOrderLookup(rcpt, mem, true, w, r)
+		return
+	}
+
+	err := ClaimGuestOrder(rcpt.Order.Id, mem.Id, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to attach order: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/orders/my", 301)
+}
+
+// Serves /orders/lookup/<uuid> and the invoice at /orders/lookup/<uuid>.pdf
+// without requiring a login.
+func HandleOrderLookup(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleOrderLookup() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	uuid := strings.TrimPrefix(r.URL.Path, "/orders/lookup/")
+	pdf := strings.HasSuffix(uuid, ".pdf")
+	uuid = strings.TrimSuffix(uuid, ".pdf")
+
+	DatabaseMutex.Lock()
+	rcpt, err := FetchReceiptByUuid(uuid, Database)
+	DatabaseMutex.Unlock()
+
+	// Orders of members stay with their owner
+	if err != nil || rcpt.Order.Member != 0 && rcpt.Order.Member != mem.Id && !HasPermission(mem, "orders.view") {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	if pdf && r.Method == "GET" {
+		ServeInvoice(rcpt, w, r)
+	} else if pdf {
+		http.Error(w, "Method not supported", 405)
+	} else if r.Method == "GET" {
+		GetOrderLookup(rcpt, mem, false, w, r)
+	} else if r.Method == "POST" {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		PostOrderLookup(rcpt, sess, mem, w, r)
+	} else {
+		http.Error(w, "Method not supported", 405)
+	}
+}
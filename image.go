@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const MaxUploadSize int64 = 32 << 20
+const ThumbnailSize int = 256
+
+// Largest image accepted, in pixels. Decoding allocates memory for all of them.
+const MaxImagePixels int64 = 40 << 20
+
+func InitializeImages() error {
+	return os.MkdirAll(GlobalConfig.Images, 0755)
+}
+
+// File name of the thumbnail belonging to image name.
+func ThumbnailName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "_thumb.jpg"
+}
+
+func FetchProductImages(prodId int64, database *sql.DB) ([]string, error) {
+	rows, err := database.Query("SELECT filename FROM product_images WHERE product = ? ORDER BY id", prodId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := make([]string, 0)
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		imgs = append(imgs, name)
+	}
+	rows.Close()
+
+	return imgs, nil
+}
+
+// Decodes the uploaded image and stores it and a thumbnail in the image
+// directory. Doesn't touch the database, call it without holding
+// DatabaseMutex and add the image to a product with AddProductImages.
+func StoreImage(fh *multipart.FileHeader) (string, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a supported image", fh.Filename)
+	}
+
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxImagePixels {
+		return "", fmt.Errorf("%s is too large (%dx%d pixels)", fh.Filename, cfg.Width, cfg.Height)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a supported image", fh.Filename)
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	name := hex.EncodeToString(id) + "." + format
+
+	err = ioutil.WriteFile(filepath.Join(GlobalConfig.Images, name), data, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	thumb, err := os.Create(filepath.Join(GlobalConfig.Images, ThumbnailName(name)))
+	if err != nil {
+		os.Remove(filepath.Join(GlobalConfig.Images, name))
+		return "", err
+	}
+
+	err = jpeg.Encode(thumb, Thumbnail(img, ThumbnailSize), &jpeg.Options{Quality: 85})
+	thumb.Close()
+
+	if err != nil {
+		RemoveImageFiles(name)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Stores all images uploaded in the "images" field of a multipart form, see
+// StoreImage. Nothing is kept if one of them fails.
+func StoreUploadedImages(r *http.Request) ([]string, error) {
+	names := make([]string, 0)
+	if r.MultipartForm == nil {
+		return names, nil
+	}
+
+	for _, fh := range r.MultipartForm.File["images"] {
+		name, err := StoreImage(fh)
+		if err != nil {
+			for _, n := range names {
+				RemoveImageFiles(n)
+			}
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Adds images stored by StoreImage to the product.
+func AddProductImages(prodId int64, names []string, database *sql.DB) error {
+	for _, name := range names {
+		_, err := database.Exec("INSERT INTO product_images VALUES ( NULL, ?, ? )", prodId, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the files of images stored by StoreImage that didn't make it into
+// the database.
+func DiscardImages(names []string) {
+	for _, name := range names {
+		RemoveImageFiles(name)
+	}
+}
+
+func DeleteProductImage(prodId int64, name string, database *sql.DB) error {
+	res, err := database.Exec("DELETE FROM product_images WHERE product = ? AND filename = ?", prodId, name)
+	if err != nil {
+		return err
+	}
+
+	cnt, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if cnt == 0 {
+		return fmt.Errorf("No such image")
+	}
+
+	RemoveImageFiles(name)
+	return nil
+}
+
+func DeleteProductImages(prodId int64, database *sql.DB) error {
+	imgs, err := FetchProductImages(prodId, database)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM product_images WHERE product = ?", prodId)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range imgs {
+		RemoveImageFiles(name)
+	}
+
+	return nil
+}
+
+func RemoveImageFiles(name string) {
+	os.Remove(filepath.Join(GlobalConfig.Images, name))
+	os.Remove(filepath.Join(GlobalConfig.Images, ThumbnailName(name)))
+}
+
+// Scales img down to fit into a size x size square by averaging the source
+// pixels covered by each destination pixel. Transparent areas become white.
+func Thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if w > size || h > size {
+		if w > h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			// Alpha premultiplied colors, blend onto white
+			white := 0xffff*n - a
+			thumb.Set(x, y, color.RGBA64{
+				uint16((r + white) / n),
+				uint16((g + white) / n),
+				uint16((bl + white) / n),
+				0xffff,
+			})
+		}
+	}
+
+	return thumb
+}
+
+func HandleImage(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/images/")
+
+	if name == "" || name != filepath.Base(name) || name[0:1] == "." {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(GlobalConfig.Images, name))
+}
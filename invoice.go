@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/jung-kurt/gofpdf"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Issuer details printed on invoices
+type InvoiceConfiguration struct {
+	Prefix    string   // Put in front of invoice numbers, e.g. "RE-"
+	Address   []string // Lines of the postal address of the issuer
+	TaxNotice string   // E.g. the VAT exemption of small businesses
+	Footer    []string // Additional lines at the bottom of every page
+}
+
+type Invoice struct {
+	Number int64
+	Order  int64
+	Date   int64 // Unix time
+}
+
+// Invoice number as printed, e.g. "RE-00042".
+func (inv Invoice) Name() string {
+	return fmt.Sprintf("%s%05d", GlobalConfig.Invoice.Prefix, inv.Number)
+}
+
+// Returns the invoice of the order, issuing a new one with the next number
+// on first use. Invoice numbers are never reused, even if the order is
+// deleted.
+func FetchOrCreateInvoice(rcpt Receipt, database *sql.DB) (Invoice, error) {
+	inv := Invoice{Order: rcpt.Order.Id}
+
+	err := database.QueryRow("SELECT number, date FROM invoices WHERE orderid = ?", inv.Order).Scan(&inv.Number, &inv.Date)
+	if err == nil {
+		return inv, nil
+	} else if err != sql.ErrNoRows {
+		return Invoice{}, err
+	}
+
+	inv.Date = time.Now().Unix()
+	res, err := database.Exec("INSERT INTO invoices VALUES ( (SELECT COALESCE(MAX(number), 0) + 1 FROM invoices), ?, ? )", inv.Order, inv.Date)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	inv.Number, err = res.LastInsertId()
+	return inv, err
+}
+
+// Renders the invoice for the order placed by owner as PDF.
+func InvoicePDF(inv Invoice, rcpt Receipt, owner Member) ([]byte, error) {
+	cfg := GlobalConfig.Invoice
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetTitle("Rechnung "+inv.Name(), true)
+	pdf.SetAuthor(GlobalConfig.Payment.Beneficiary, true)
+	pdf.SetAutoPageBreak(true, 30)
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-25)
+		pdf.SetFont("Helvetica", "", 8)
+
+		lines := append([]string{}, cfg.Footer...)
+		lines = append(lines, fmt.Sprintf("%s, IBAN %s", GlobalConfig.Payment.Beneficiary, FormatIBAN(GlobalConfig.Payment.IBAN)))
+		for _, l := range lines {
+			pdf.CellFormat(0, 4, tr(l), "", 1, "C", false, 0, "")
+		}
+	})
+
+	pdf.AddPage()
+
+	// Sender line and recipient
+	pdf.SetFont("Helvetica", "", 8)
+	pdf.CellFormat(0, 5, tr(strings.Join(cfg.Address, " · ")), "", 1, "L", false, 0, "")
+	pdf.Ln(2)
+
+	pdf.SetFont("Helvetica", "", 11)
+	if rcpt.BillingAddress != nil {
+		for _, l := range rcpt.BillingAddress.Lines() {
+			pdf.CellFormat(0, 5, tr(l), "", 1, "L", false, 0, "")
+		}
+	} else {
+		pdf.CellFormat(0, 5, tr(owner.Name), "", 1, "L", false, 0, "")
+		pdf.CellFormat(0, 5, tr(rcpt.Order.ContactEMail(owner)), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(15)
+
+	// Issuer and invoice details
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 8, tr("Rechnung "+inv.Name()), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 5, "Rechnungsdatum: "+time.Unix(inv.Date, 0).Format("02.01.2006"), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 5, "Bestelldatum: "+time.Unix(rcpt.Order.Date, 0).Format("02.01.2006"), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 5, "Bestellnummer: "+rcpt.Order.Uuid, "", 1, "L", false, 0, "")
+	if rcpt.SeparateBilling() && rcpt.Address != nil {
+		pdf.CellFormat(0, 5, tr("Lieferadresse: "+strings.Join(rcpt.Address.Lines(), ", ")), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(10)
+
+	// Line items
+	widths := []float64{12, 88, 20, 25, 25}
+	pdf.SetFont("Helvetica", "B", 10)
+	for i, h := range []string{"Pos.", "Artikel", "Menge", "Einzelpreis", "Gesamt"} {
+		align := "R"
+		if i == 1 {
+			align = "L"
+		}
+		pdf.CellFormat(widths[i], 7, h, "B", 0, align, false, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 10)
+	for i, itm := range rcpt.Cart {
+		pdf.CellFormat(widths[0], 6, strconv.Itoa(i+1), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[1], 6, tr(itm.Name()), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 6, strconv.FormatUint(itm.Amount, 10), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 6, tr(FormatMoney(itm.Product.Price)+" €"), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, tr(FormatMoney(itm.Product.Price*itm.Amount)+" €"), "", 1, "R", false, 0, "")
+	}
+
+	if rcpt.Discount > 0 {
+		pdf.CellFormat(widths[0], 6, "", "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[1], 6, tr("Gutschein "+rcpt.Order.Coupon), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2]+widths[3], 6, "", "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, tr("-"+FormatMoney(rcpt.Discount)+" €"), "", 1, "R", false, 0, "")
+	}
+
+	if ship := rcpt.Order.Shipping; ship.Name != "" {
+		pdf.CellFormat(widths[0], 6, strconv.Itoa(len(rcpt.Cart)+1), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[1], 6, tr("Versand: "+ship.Name), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 6, "1", "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 6, tr(FormatMoney(ship.Price)+" €"), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, tr(FormatMoney(ship.Price)+" €"), "", 1, "R", false, 0, "")
+	}
+
+	label := widths[0] + widths[1] + widths[2] + widths[3]
+	if rcpt.Order.NetPrices {
+		pdf.CellFormat(label, 6, "Zwischensumme (netto)", "T", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, tr(FormatMoney(rcpt.Subtotal-rcpt.Discount+rcpt.Order.Shipping.Price)+" €"), "T", 1, "R", false, 0, "")
+
+		for _, t := range rcpt.Taxes {
+			pdf.CellFormat(label, 6, tr(fmt.Sprintf("zzgl. %s %% MwSt. auf %s €", FormatTaxRate(t.Rate), FormatMoney(t.Net))), "", 0, "R", false, 0, "")
+			pdf.CellFormat(widths[4], 6, tr(FormatMoney(t.Tax)+" €"), "", 1, "R", false, 0, "")
+		}
+	}
+
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(label, 7, "Summe", "T", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[4], 7, tr(FormatMoney(rcpt.Sum)+" €"), "T", 1, "R", false, 0, "")
+
+	if !rcpt.Order.NetPrices {
+		pdf.SetFont("Helvetica", "", 10)
+		for _, t := range rcpt.Taxes {
+			pdf.CellFormat(label, 6, tr(fmt.Sprintf("enthaltene %s %% MwSt. auf %s € netto", FormatTaxRate(t.Rate), FormatMoney(t.Net))), "", 0, "R", false, 0, "")
+			pdf.CellFormat(widths[4], 6, tr(FormatMoney(t.Tax)+" €"), "", 1, "R", false, 0, "")
+		}
+	}
+	pdf.Ln(8)
+
+	pdf.SetFont("Helvetica", "", 10)
+	if cfg.TaxNotice != "" {
+		pdf.MultiCell(0, 5, tr(cfg.TaxNotice), "", "L", false)
+		pdf.Ln(3)
+	}
+
+	if rcpt.Order.Status == "new" {
+		pdf.MultiCell(0, 5, tr(fmt.Sprintf("Bitte überweise den Betrag mit dem Verwendungszweck %s an %s, IBAN %s.", rcpt.Order.Uuid, GlobalConfig.Payment.Beneficiary, FormatIBAN(GlobalConfig.Payment.IBAN))), "", "L", false)
+	} else {
+		pdf.MultiCell(0, 5, "Der Betrag wurde bereits bezahlt. Vielen Dank!", "", "L", false)
+	}
+
+	buf := new(bytes.Buffer)
+	err := pdf.Output(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Serves the invoice of the order with the id in the path to its owner and
+// to admins.
+func HandleInvoice(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleInvoice() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	ordId, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orders/invoice/"), ".pdf"), 10, 64)
+	if err != nil {
+		http.Error(w, "Order not found: "+err.Error(), 404)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	rcpt, err := FetchReceipt(ordId, Database)
+	DatabaseMutex.Unlock()
+
+	// Don't tell others whether the order exists
+	if err != nil || (mem.Id == 0 || rcpt.Order.Member != mem.Id) && !HasPermission(mem, "orders.view") {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	ServeInvoice(rcpt, w, r)
+}
+
+// Writes the invoice of the order, issuing one if necessary. Callers check
+// whether the request may see it.
+func ServeInvoice(rcpt Receipt, w http.ResponseWriter, r *http.Request) {
+	if rcpt.Order.Status == "cancelled" {
+		http.Error(w, "Order was cancelled", 410)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	owner, err := FetchMember(rcpt.Order.Member, Database)
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	inv, err := FetchOrCreateInvoice(rcpt, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to create invoice: "+err.Error(), 500)
+		return
+	}
+
+	doc, err := InvoicePDF(inv, rcpt, owner)
+	if err != nil {
+		http.Error(w, "Failed to create invoice: "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"Rechnung-%s.pdf\"", inv.Name()))
+	w.Write(doc)
+}
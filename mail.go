@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type MailConfiguration struct {
+	Transport string // "smtp", "maildir" or empty to disable mails
+	From      string // Sender address
+	Host      string // SMTP server as host:port
+	User      string // SMTP user name, no authentication if empty
+	Password  string
+	Maildir   string // Directory mails are stored in by the maildir transport
+}
+
+// File sent along with a mail
+type MailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+type Mailer interface {
+	Send(to string, msg []byte) error
+}
+
+// Delivers mails to an SMTP server.
+type SMTPMailer struct {
+	Host     string
+	User     string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(to string, msg []byte) error {
+	var auth smtp.Auth
+
+	if m.User != "" {
+		host, _, err := net.SplitHostPort(m.Host)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Host, auth, m.From, []string{to}, msg)
+}
+
+// Stores mails in a local Maildir instead of sending them. Useful for
+// testing.
+type MaildirMailer struct {
+	Dir string
+}
+
+func (m MaildirMailer) Send(to string, msg []byte) error {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d.%s.shop", time.Now().UnixNano(), hex.EncodeToString(id))
+	tmp := filepath.Join(m.Dir, "tmp", name)
+
+	err = ioutil.WriteFile(tmp, msg, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(m.Dir, "new", name))
+}
+
+var GlobalMailer Mailer
+var MailTemplateCache *template.Template
+
+func InitializeMailer() error {
+	cfg := GlobalConfig.Mail
+
+	switch cfg.Transport {
+	case "":
+		log.Println("No mail transport configured, mails will not be sent")
+		GlobalMailer = nil
+	case "smtp":
+		GlobalMailer = SMTPMailer{cfg.Host, cfg.User, cfg.Password, cfg.From}
+	case "maildir":
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			err := os.MkdirAll(filepath.Join(cfg.Maildir, sub), 0700)
+			if err != nil {
+				return err
+			}
+		}
+		GlobalMailer = MaildirMailer{cfg.Maildir}
+	default:
+		return errors.New("Unknown mail transport '" + cfg.Transport + "'")
+	}
+
+	return nil
+}
+
+// Executes the mail template tmpl. The first line of the output must be the
+// subject ("Subject: ..."), followed by an empty line and the body. Mails with
+// attachments are sent as multipart/mixed.
+func RenderMail(to string, tmpl string, data interface{}, attachments ...MailAttachment) ([]byte, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return nil, errors.New("Invalid recipient address")
+	}
+
+	t := MailTemplateCache.Lookup(tmpl)
+	if t == nil {
+		return nil, errors.New("Mail template '" + tmpl + "' not found")
+	}
+
+	buf := new(bytes.Buffer)
+	err := t.Execute(buf, data)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(strings.TrimLeft(buf.String(), "\r\n"), "\n\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject: ") {
+		return nil, errors.New("Mail template '" + tmpl + "' has no subject")
+	}
+
+	subject := strings.TrimSpace(strings.TrimPrefix(parts[0], "Subject: "))
+	body := strings.Replace(strings.TrimSpace(parts[1]), "\n", "\r\n", -1)
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", GlobalConfig.Mail.From)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+
+	if len(attachments) == 0 {
+		fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(msg, "Content-Transfer-Encoding: 8bit\r\n")
+		fmt.Fprintf(msg, "\r\n%s\r\n", body)
+
+		return msg.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(msg)
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(pw, "%s\r\n", body)
+
+	for _, att := range attachments {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(att.ContentType, map[string]string{"name": att.Name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": att.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Lines of encoded data must not be longer than 76 characters
+		enc := base64.StdEncoding.EncodeToString(att.Data)
+		for len(enc) > 76 {
+			fmt.Fprintf(pw, "%s\r\n", enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(pw, "%s\r\n", enc)
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+// Renders the mail template and sends the result to the given address in the
+// background. Errors are only logged.
+func SendMail(to string, tmpl string, data interface{}, attachments ...MailAttachment) {
+	if GlobalMailer == nil || to == "" {
+		return
+	}
+
+	msg, err := RenderMail(to, tmpl, data, attachments...)
+	if err != nil {
+		log.Println("Failed to render mail '" + tmpl + "': " + err.Error())
+		return
+	}
+
+	go func() {
+		err := GlobalMailer.Send(to, msg)
+		if err != nil {
+			log.Println("Failed to send mail '" + tmpl + "' to " + to + ": " + err.Error())
+		}
+	}()
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
 type Configuration struct {
@@ -13,9 +15,18 @@ type Configuration struct {
 	Listen       string // URL to listen on
 	CookieDomain string
 	CookieSecure bool
-	Salt         string // Salt used for password hashing
+	Salt         string // Salt of password hashes created before per-member salts
+	PasswordHash string // Algorithm for new password hashes: "argon2id" (default), "bcrypt" or "pbkdf2-sha256"
 	Templates    string // Path to the template dir
 	Database     string // Path to the SQLite database
+	Images       string // Path to the directory uploaded product images are stored in
+	Url          string // Scheme and host the shop is reachable at, used in mails
+	Mail         MailConfiguration
+	Payment      PaymentConfiguration
+	Invoice      InvoiceConfiguration
+	Tax          TaxConfiguration
+	Shipping     []ShippingMethod // Offered in this order, the first available one is preselected
+	Groups       []MemberGroup    // Member groups besides "admin" and "customer", e.g. for member prices or volunteers
 }
 
 const Version string = "0.1"
@@ -24,6 +35,9 @@ const ConfigFile string = "config.json"
 var GlobalConfig Configuration
 
 func main() {
+	dryRun := flag.Bool("dry-run", false, "Print pending database migrations and exit")
+	flag.Parse()
+
 	fmt.Println(`LABOR Shop  Copyright (C) 2015 Kai Michaelis
 This program comes with ABSOLUTELY NO WARRANTY.
 This is free software, and you are welcome to redistribute it
@@ -41,12 +55,51 @@ under certain conditions.`)
 		log.Fatal(err)
 	}
 
+	err = CheckPasswordAlgorithm(GlobalConfig.PasswordHash)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = CheckPaymentConfiguration(GlobalConfig.Payment)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = CheckTaxConfiguration(GlobalConfig.Tax)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = CheckShippingConfiguration(GlobalConfig.Shipping)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = CheckGroupConfiguration(GlobalConfig.Groups)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	err = InitializeTemplates()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = InitializeDatabase()
+	err = InitializeMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = InitializeDatabase(*dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryRun {
+		return
+	}
+
+	err = InitializeImages()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -55,5 +108,7 @@ under certain conditions.`)
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.ListenAndServe(GlobalConfig.Listen, nil)
+
+	StartReservationReaper(time.Hour)
+	http.ListenAndServe(GlobalConfig.Listen, SessionHandler(http.DefaultServeMux))
 }
@@ -1,28 +1,29 @@
 package main
 
 import (
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"golang.org/x/crypto/pbkdf2"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Member struct {
-	Id     int64
-	Name   string
-	EMail  string
-	Passwd string
-	Group  string
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	EMail  string `json:"email"`
+	Passwd string `json:"-"`
+	Group  string `json:"group"`
 }
 
+// Minimum length of member passwords
+const MinPasswordLength int = 8
+
 func MemberFromRow(rows *sql.Rows) Member {
 	var name, email, passwd, group string
 	var id int64
@@ -40,16 +41,17 @@ func MemberFromRow(rows *sql.Rows) Member {
 	}
 }
 
-func HashPassword(passwd string) string {
-	return hex.EncodeToString(pbkdf2.Key([]byte(passwd), []byte(GlobalConfig.Salt), 8192, 32, sha256.New))
-}
-
 func NewMember(name string, email string, passwd string, group string, database *sql.DB) (Member, error) {
+	hash, err := HashPassword(passwd)
+	if err != nil {
+		return Member{}, err
+	}
+
 	mem := Member{
 		Id:     0,
 		Name:   name,
 		EMail:  email,
-		Passwd: HashPassword(passwd),
+		Passwd: hash,
 		Group:  group,
 	}
 	res, err := database.Exec("INSERT INTO members VALUES ( NULL, ?, ?, ?, ? )", mem.Name, mem.EMail, mem.Passwd, mem.Group)
@@ -86,6 +88,13 @@ func FetchMember(id int64, database *sql.DB) (Member, error) {
 	return mem, nil
 }
 
+func IsEMail(email string) bool {
+	matched, err := regexp.MatchString(".+@.+", email)
+	return err == nil && matched
+}
+
+// The password is returned in plain text and empty if none or a too short one
+// was given.
 func MemberFromForm(form url.Values) (Member, error) {
 	var ok bool
 	var names, emails, passwds, groups []string
@@ -103,22 +112,24 @@ func MemberFromForm(form url.Values) (Member, error) {
 		return Member{}, fmt.Errorf("No email given")
 	} else {
 		email = emails[0]
-		matched, err := regexp.MatchString(".+@.+", email)
 
-		if err != nil || !matched {
+		if !IsEMail(email) {
 			return Member{}, fmt.Errorf("Not an email address")
 		}
 	}
 
 	passwds, ok = form["passwd"]
-	if ok && len(passwds) == 1 && len(passwds[0]) >= 8 {
+	if ok && len(passwds) == 1 && len(passwds[0]) >= MinPasswordLength {
 		passwd = passwds[0]
 	} else {
 		passwd = ""
 	}
 
 	groups, ok = form["group"]
-	if ok && len(groups) == 1 && (groups[0] == "admin" || groups[0] == "customer") {
+	if ok && len(groups) == 1 && groups[0] != "" {
+		if !IsMemberGroup(groups[0]) {
+			return Member{}, fmt.Errorf("Unknown group '%s'", groups[0])
+		}
 		group = groups[0]
 	} else {
 		group = "customer"
@@ -128,69 +139,83 @@ func MemberFromForm(form url.Values) (Member, error) {
 		Id:     0,
 		Name:   name,
 		EMail:  email,
-		Passwd: HashPassword(passwd),
+		Passwd: passwd,
 		Group:  group,
 	}, nil
 }
 
-func PostNewMember(cur_mem Member, w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-
+// Fails if another member than id is called name.
+func CheckMemberName(name string, id int64, database *sql.DB) error {
+	rows, err := database.Query("SELECT * FROM members WHERE name = ? AND id <> ?", name, id)
 	if err != nil {
-		http.Error(w, "Failed create member: "+err.Error(), 500)
+		return err
 	}
 
-	new_mem, err := MemberFromForm(r.PostForm)
+	exists := rows.Next()
+	rows.Close()
 
-	if err != nil {
-		http.Error(w, "Failed create member: "+err.Error(), 400)
-		return
+	if exists {
+		return NewStatusError(400, "exists already")
 	}
+	return nil
+}
 
-	DatabaseMutex.Lock()
+// Creates a customer account from the output of MemberFromForm, logs the
+// session in and sends a welcome mail.
+func RegisterMember(new_mem Member, session Session, database *sql.DB) (Member, error) {
+	if new_mem.Passwd == "" {
+		return Member{}, NewStatusError(400, "passwords must be %d characters or longer", MinPasswordLength)
+	}
 
-	var rows *sql.Rows
-	rows, err = Database.Query("SELECT * FROM members WHERE name = ?", new_mem.Name)
+	err := CheckMemberName(new_mem.Name, 0, database)
+	if err != nil {
+		return Member{}, err
+	}
 
+	mem, err := NewMember(new_mem.Name, new_mem.EMail, new_mem.Passwd, "customer", database)
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed create member: "+err.Error(), 500)
-		return
+		return Member{}, err
 	}
 
-	exists := rows.Next()
-	rows.Close()
-	DatabaseMutex.Unlock()
+	err = LoginSession(session.Id, mem.Id, database)
+	if err != nil {
+		return Member{}, fmt.Errorf("Failed to associate sessions to member: %s", err.Error())
+	}
 
-	if exists {
-		http.Error(w, "Failed create member: exists already", 400)
+	SendMail(mem.EMail, "mails/registration", mem)
+	return mem, nil
+}
+
+func PostNewMember(cur_mem Member, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+
+	if err != nil {
+		http.Error(w, "Failed create member: "+err.Error(), 500)
 		return
 	}
 
-	DatabaseMutex.Lock()
-	mem2, err := NewMember(new_mem.Name, new_mem.EMail, new_mem.Passwd, "customer", Database)
+	new_mem, err := MemberFromForm(r.PostForm)
 
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed create member: "+err.Error(), 500)
+		http.Error(w, "Failed create member: "+err.Error(), 400)
 		return
 	}
 
+	DatabaseMutex.Lock()
 	sess := FetchOrCreateSession(w, r, Database)
-	err = LoginSession(sess.Id, mem2.Id, Database)
-
+	mem2, err := RegisterMember(new_mem, sess, Database)
 	DatabaseMutex.Unlock()
 
 	if err != nil {
-		http.Error(w, "Failed to associate sessions to member: "+err.Error(), 500)
+		http.Error(w, "Failed create member: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	RenderTemplate(w, "members/success", "", mem2, "")
+	RenderTemplate(w, r, "members/success", "", mem2, "")
 }
 
 func ResetPasswd(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Request) {
-	if cur_mem.Group != "admin" {
+	if !HasPermission(cur_mem, "members.manage") || !CanManageGroup(cur_mem, mem.Group) {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
@@ -202,19 +227,44 @@ func ResetPasswd(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Requ
 	}
 
 	passwds, ok := r.PostForm["passwd"]
-	if ok && len(passwds) == 1 && len(passwds[0]) >= 8 {
+	if ok && len(passwds) == 1 && len(passwds[0]) >= MinPasswordLength {
+		hash, err := HashPassword(passwds[0])
+		if err != nil {
+			http.Error(w, "Failed to reset password: "+err.Error(), 500)
+			return
+		}
+
 		DatabaseMutex.Lock()
-		_, err = Database.Exec("UPDATE members SET passwd = ? WHERE id = ?", HashPassword(passwds[0]), mem.Id)
+		_, err = Database.Exec("UPDATE members SET passwd = ? WHERE id = ?", hash, mem.Id)
 		DatabaseMutex.Unlock()
 
+		if err != nil {
+			http.Error(w, "Failed to reset password: "+err.Error(), 500)
+			return
+		}
+
+		SendMail(mem.EMail, "mails/passwd", mem)
+
 		http.Redirect(w, r, "/members/"+strconv.FormatInt(mem.Id, 10), 301)
 	} else {
 		http.Error(w, "Failed to reset password: passwords must be 8 characters or longer", 500)
 	}
 }
 
+// Updates name, email address and group of the member. The password is left
+// alone.
+func UpdateMember(mem Member, database *sql.DB) error {
+	err := CheckMemberName(mem.Name, mem.Id, database)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("UPDATE members SET name = ?, email = ?, grp = ? WHERE id = ?", mem.Name, mem.EMail, mem.Group, mem.Id)
+	return err
+}
+
 func PutMember(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Request) {
-	if cur_mem.Group != "admin" {
+	if !HasPermission(cur_mem, "members.manage") || !CanManageGroup(cur_mem, mem.Group) {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
@@ -232,92 +282,108 @@ func PutMember(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	DatabaseMutex.Lock()
+	if !CanManageGroup(cur_mem, new_mem.Group) {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
 
-	var rows *sql.Rows
-	rows, err = Database.Query("SELECT * FROM members WHERE name = ? AND id <> ?", new_mem.Name, mem.Id)
+	new_mem.Id = mem.Id
+
+	DatabaseMutex.Lock()
+	err = UpdateMember(new_mem, Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to update member: "+err.Error(), 500)
+		http.Error(w, "Failed to update member: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	exists := rows.Next()
-	rows.Close()
-	DatabaseMutex.Unlock()
+	http.Redirect(w, r, "/members/"+strconv.FormatInt(mem.Id, 10), 301)
+}
 
-	if exists {
-		http.Error(w, "Failed to update member: name exists already", 400)
-		return
+// Deletes the member and logs out all of its sessions.
+func RemoveMember(mem Member, database *sql.DB) error {
+	if mem.Id == 0 {
+		return NewStatusError(400, "can't delete the guest member")
 	}
 
-	DatabaseMutex.Lock()
-	_, err = Database.Exec("UPDATE members SET name = ?, email = ?, grp = ? WHERE id = ?", new_mem.Name, new_mem.EMail, new_mem.Group, mem.Id)
-	DatabaseMutex.Unlock()
+	err := DeleteMemberSessions(mem.Id, database)
+	if err != nil {
+		return err
+	}
 
+	_, err = database.Exec("DELETE FROM api_tokens WHERE member = ?", mem.Id)
 	if err != nil {
-		http.Error(w, "Failed to update member: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	http.Redirect(w, r, "/members/"+strconv.FormatInt(mem.Id, 10), 301)
+	_, err = database.Exec("DELETE FROM addresses WHERE member = ?", mem.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM carts WHERE member = ?", mem.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM members WHERE id = ?", mem.Id)
+	return err
 }
 
 func DeleteMember(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Request) {
-	if cur_mem.Group != "admin" {
+	if !HasPermission(cur_mem, "members.manage") || !CanManageGroup(cur_mem, mem.Group) {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
 
 	DatabaseMutex.Lock()
-	rows, err := Database.Query("DELETE FROM members WHERE id = ?", mem.Id)
+	err := RemoveMember(mem, Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		http.Error(w, "Failed delete member: "+err.Error(), 500)
-		DatabaseMutex.Unlock()
+		http.Error(w, "Failed delete member: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	exists := rows.Next()
-	rows.Close()
-	DatabaseMutex.Unlock()
+	http.Redirect(w, r, "/members/", 301)
+}
 
-	if exists {
-		http.Error(w, "Failed delete member: does not exists", 400)
-		return
+func FetchMembers(database *sql.DB) ([]Member, error) {
+	rows, err := database.Query("SELECT * FROM members")
+	if err != nil {
+		return nil, err
 	}
 
-	http.Redirect(w, r, "/members/", 301)
+	mems := make([]Member, 0)
+	for rows.Next() {
+		mems = append(mems, MemberFromRow(rows))
+	}
+	rows.Close()
+
+	return mems, nil
 }
 
 func GetMembers(mem Member, w http.ResponseWriter, r *http.Request) {
-	if mem.Group != "admin" {
+	if !HasPermission(mem, "members.view") {
 		http.Error(w, "Unsufficient permissions", 403)
 		return
 	}
 
 	DatabaseMutex.Lock()
-	rows, err := Database.Query("SELECT * FROM members")
+	mems, err := FetchMembers(Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		DatabaseMutex.Unlock()
 		http.Error(w, "Failed to read members from database: "+err.Error(), 500)
 		return
 	}
 
-	mems := make([]Member, 0)
-
-	for rows.Next() {
-		mems = append(mems, MemberFromRow(rows))
-	}
-	DatabaseMutex.Unlock()
-
-	RenderTemplate(w, "members/list", "", mem, mems)
+	RenderTemplate(w, r, "members/list", "", mem, mems)
 }
 
 func GetMember(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Request) {
-	if cur_mem.Group != "admin" {
+	if !HasPermission(cur_mem, "members.view") {
 		http.Error(w, "Unsufficient permissions", 403)
 		return
 	}
@@ -339,7 +405,7 @@ func GetMember(mem Member, cur_mem Member, w http.ResponseWriter, r *http.Reques
 	mem2 := MemberFromRow(rows)
 	rows.Close()
 	DatabaseMutex.Unlock()
-	RenderTemplate(w, "members/single", mem.Name, cur_mem, mem2)
+	RenderTemplate(w, r, "members/single", mem.Name, cur_mem, mem2)
 }
 
 func HandleMember(w http.ResponseWriter, r *http.Request) {
@@ -367,8 +433,27 @@ func HandleMember(w http.ResponseWriter, r *http.Request) {
 	} else {
 		suff := strings.TrimPrefix(r.URL.Path, "/members/")
 		matched, err := regexp.MatchString("[0-9]+/passwd/?", suff)
+		sessMatched, sessErr := regexp.MatchString("^[0-9]+/sessions/?$", suff)
+
+		if sessErr == nil && sessMatched {
+			memId, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSuffix(suff, "/"), "/sessions"), 10, 64)
+
+			if err != nil {
+				http.Error(w, "Member not found: "+err.Error(), 404)
+				return
+			}
 
-		if err == nil && matched && r.Method == "POST" {
+			DatabaseMutex.Lock()
+			mem2, err := FetchMember(memId, Database)
+			DatabaseMutex.Unlock()
+
+			if err != nil {
+				http.Error(w, "Member not found: "+err.Error(), 404)
+				return
+			}
+
+			HandleMemberSessions(mem2, cur_mem, sess, w, r)
+		} else if err == nil && matched && r.Method == "POST" {
 			fmt.Println("in")
 			memId, err := strconv.ParseInt(strings.TrimSuffix(suff, "/passwd"), 10, 64)
 
@@ -468,12 +553,11 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 
 		passwd := passwds[0]
-		hashed := pbkdf2.Key([]byte(passwd), []byte(GlobalConfig.Salt), 8192, 32, sha256.New)
 
 		DatabaseMutex.Lock()
 
 		var rows *sql.Rows
-		rows, err = Database.Query("SELECT id FROM members WHERE name = ? AND passwd = ?", name, hex.EncodeToString(hashed))
+		rows, err = Database.Query("SELECT id, passwd FROM members WHERE name = ? AND id <> 0", name)
 
 		if err != nil {
 			DatabaseMutex.Unlock()
@@ -485,6 +569,7 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		exists := rows.Next()
 
 		if !exists {
+			rows.Close()
 			DatabaseMutex.Unlock()
 			http.Error(w, "Invalid username or password", 500)
 			log.Print("Login: SELECT did not return anything")
@@ -492,7 +577,8 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var memid int64
-		err = rows.Scan(&memid)
+		var hash string
+		err = rows.Scan(&memid, &hash)
 		rows.Close()
 
 		if err != nil {
@@ -502,6 +588,27 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		ok, rehash := VerifyPassword(passwd, hash)
+		if !ok {
+			DatabaseMutex.Unlock()
+			http.Error(w, "Invalid username or password", 500)
+			log.Print("Login: wrong password")
+			return
+		}
+
+		// Upgrade hashes with outdated algorithm or parameters while we
+		// know the password
+		if rehash {
+			hash, err = HashPassword(passwd)
+			if err == nil {
+				_, err = Database.Exec("UPDATE members SET passwd = ? WHERE id = ?", hash, memid)
+			}
+
+			if err != nil {
+				log.Print("Login: can't rehash password (" + err.Error() + ")")
+			}
+		}
+
 		err = LoginSession(sess.Id, memid, Database)
 		if err != nil {
 			DatabaseMutex.Unlock()
@@ -511,8 +618,73 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 
 		DatabaseMutex.Unlock()
-		RenderTemplate(w, "members/success", "", mem, "")
+		RenderTemplate(w, r, "members/success", "", mem, "")
 	} else {
 		http.Error(w, "Method not supported", 405)
 	}
 }
+
+// Lets admins list and revoke all sessions of a member.
+func HandleMemberSessions(mem Member, cur_mem Member, sess Session, w http.ResponseWriter, r *http.Request) {
+	if !HasPermission(cur_mem, "members.manage") || !CanManageGroup(cur_mem, mem.Group) {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	meth := r.Method
+	if r.Method == "POST" {
+		err := r.ParseForm()
+
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		meths, ok := r.PostForm["_method"]
+		if ok && len(meths) == 1 && len(meths[0]) > 0 {
+			meth = meths[0]
+		}
+	}
+
+	if meth == "GET" {
+		GetSessions(mem, cur_mem, sess, w, r)
+	} else if meth == "DELETE" {
+		DatabaseMutex.Lock()
+		err := DeleteMemberSessions(mem.Id, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Failed to revoke sessions: "+err.Error(), 500)
+			return
+		}
+
+		http.Redirect(w, r, "/members/"+strconv.FormatInt(mem.Id, 10)+"/sessions", 301)
+	} else {
+		http.Error(w, "Method not supported", 405)
+	}
+}
+
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	c, err := r.Cookie("sessid")
+	if err == nil {
+		DatabaseMutex.Lock()
+		err = DeleteSession(c.Value, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Failed to log out: "+err.Error(), 500)
+			return
+		}
+	}
+
+	coo := NewCookie("sessid", "", time.Unix(0, 0))
+	coo.MaxAge = -1
+	http.SetCookie(w, &coo)
+
+	http.Redirect(w, r, "/", 301)
+}
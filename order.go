@@ -5,46 +5,98 @@ import (
 	"errors"
 	"fmt"
 	"github.com/pborman/uuid"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Human readable names of all order states
+var OrderStatusNames = map[string]string{
+	"new":       "Warte auf Zahlung",
+	"paid":      "Bezahlt",
+	"packed":    "Verpackt",
+	"shipped":   "Versandt",
+	"picked-up": "Abgeholt",
+	"cancelled": "Storniert",
+	"refunded":  "Erstattet",
+}
+
+// Allowed order state transitions
+var OrderTransitions = map[string][]string{
+	"new":       {"paid", "cancelled"},
+	"paid":      {"packed", "picked-up", "refunded"},
+	"packed":    {"shipped", "picked-up", "refunded"},
+	"shipped":   {"refunded"},
+	"picked-up": {"refunded"},
+	"cancelled": {},
+	"refunded":  {},
+}
+
 type Order struct {
-	Id     int64
-	Date   int64
-	Member int64
-	Status string
-	Uuid   string
+	Id     int64  `json:"id"`
+	Date   int64  `json:"date"`
+	Member int64  `json:"member"`
+	Status string `json:"status"`
+	Uuid   string `json:"uuid"`
+	// Whether the item prices exclude tax, as configured when the order was
+	// placed
+	NetPrices bool     `json:"netPrices"`
+	Shipping  Shipping `json:"shipping"`
+	EMail     string   `json:"email"`     // Given on checkout by guests and kept when the order is claimed, empty if a member placed it
+	Coupon    string   `json:"coupon"`    // Discount code used, empty if none
+	CouponId  int64    `json:"couponId"`  // Id of the code, 0 if none or it was deleted
+	Restocked bool     `json:"restocked"` // Whether the items went back into stock when it was cancelled or refunded
 }
 
 func OrderFromRow(rows *sql.Rows) (Order, error) {
 	var status, uuid string
 	var id, mem, date int64
+	var net bool
+	var ship Shipping
+	var email, coupon string
+	var couponId int64
+	var restocked bool
 
-	err := rows.Scan(&id, &date, &mem, &status, &uuid)
+	err := rows.Scan(&id, &date, &mem, &status, &uuid, &net, &ship.Method, &ship.Name, &ship.Price, &ship.TaxRate, &email, &coupon, &couponId, &restocked)
 	if err != nil {
 		return Order{}, err
 	}
 	return Order{
-		Id:     id,
-		Date:   date,
-		Member: mem,
-		Status: status,
-		Uuid:   uuid,
+		Id:        id,
+		Date:      date,
+		Member:    mem,
+		Status:    status,
+		Uuid:      uuid,
+		NetPrices: net,
+		Shipping:  ship,
+		EMail:     email,
+		Coupon:    coupon,
+		CouponId:  couponId,
+		Restocked: restocked,
 	}, nil
 }
 
-func NewOrder(member Member, uuid string, tx *sql.Tx) (Order, error) {
+// Places a new order. coupon is the discount code used, nil for none.
+func NewOrder(member Member, uuid string, ship Shipping, email string, coupon *Coupon, tx *sql.Tx) (Order, error) {
 	ord := Order{
-		Id:     0,
-		Date:   time.Now().Unix(),
-		Member: member.Id,
-		Status: "new",
-		Uuid:   uuid,
+		Id:        0,
+		Date:      time.Now().Unix(),
+		Member:    member.Id,
+		Status:    "new",
+		Uuid:      uuid,
+		NetPrices: GlobalConfig.Tax.NetPrices,
+		Shipping:  ship,
+		EMail:     email,
 	}
-	res, err := tx.Exec("INSERT INTO orders VALUES ( NULL, ?, ?, ?, ? )", ord.Date, ord.Member, ord.Status, ord.Uuid)
+	if coupon != nil {
+		ord.Coupon, ord.CouponId = coupon.Code, coupon.Id
+	}
+
+	res, err := tx.Exec("INSERT INTO orders VALUES ( NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? )", ord.Date, ord.Member, ord.Status, ord.Uuid, ord.NetPrices,
+		ship.Method, ship.Name, ship.Price, ship.TaxRate, ord.EMail, ord.Coupon, ord.CouponId, ord.Restocked)
 
 	if err != nil {
 		return Order{}, err
@@ -52,15 +104,143 @@ func NewOrder(member Member, uuid string, tx *sql.Tx) (Order, error) {
 		var id int64
 		id, err = res.LastInsertId()
 
+		if err != nil {
+			return Order{}, err
+		}
+
+		ord.Id = id
+		_, err = tx.Exec("INSERT INTO order_status_history VALUES ( ?, ?, ? )", ord.Id, ord.Status, ord.Date)
+
 		if err != nil {
 			return Order{}, err
 		} else {
-			ord.Id = id
 			return ord, nil
 		}
 	}
 }
 
+// Address mails about the order go to.
+func (ord Order) ContactEMail(owner Member) string {
+	if ord.Member == 0 {
+		return ord.EMail
+	}
+	return owner.EMail
+}
+
+// States the order can be moved to from its current one.
+func (ord Order) NextStatuses() []string {
+	return OrderTransitions[ord.Status]
+}
+
+func CheckStatusTransition(from string, to string) error {
+	if _, ok := OrderStatusNames[to]; !ok {
+		return fmt.Errorf("Unknown status '%s'", to)
+	}
+
+	for _, s := range OrderTransitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Can't change status from '%s' to '%s'", from, to)
+}
+
+// Whether the items of the order go back into stock when its status changes.
+// Cancelled orders never left the shop, nor did orders refunded before they
+// were shipped or picked up.
+func RestocksOnStatus(from string, to string) bool {
+	return to == "cancelled" || (to == "refunded" && (from == "paid" || from == "packed"))
+}
+
+// Whether the items of the order were shipped or picked up at some point,
+// according to its status history.
+func (rcpt Receipt) LeftShop() bool {
+	for _, chg := range rcpt.History {
+		if chg.Status == "shipped" || chg.Status == "picked-up" {
+			return true
+		}
+	}
+	return false
+}
+
+// Puts the items of the order back into stock.
+func RestockOrder(rcpt Receipt, tx *sql.Tx) error {
+	for _, itm := range rcpt.Cart {
+		var err error
+		if itm.Variant != nil {
+			_, err = tx.Exec("UPDATE variants SET count = count + ? WHERE id = ?", itm.Amount, itm.Variant.Id)
+		} else {
+			_, err = tx.Exec("UPDATE products SET count = count + ? WHERE id = ?", itm.Amount, itm.Product.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Changes the status of the order and records the change in its status
+// history. Cancelled orders and ones refunded before they left the shop are
+// restocked.
+func SetOrderStatus(rcpt Receipt, status string, tx *sql.Tx) error {
+	err := CheckStatusTransition(rcpt.Order.Status, status)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE orders SET status = ? WHERE id = ?", status, rcpt.Order.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO order_status_history VALUES ( ?, ?, ? )", rcpt.Order.Id, status, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if RestocksOnStatus(rcpt.Order.Status, status) {
+		err = RestockOrder(rcpt, tx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE orders SET restocked = 1 WHERE id = ?", rcpt.Order.Id)
+		return err
+	}
+
+	return nil
+}
+
+type StatusChange struct {
+	Status string `json:"status"`
+	Date   int64  `json:"date"`
+}
+
+func FetchStatusHistory(id int64, database *sql.DB) ([]StatusChange, error) {
+	rows, err := database.Query("SELECT status, date FROM order_status_history WHERE orderid = ? ORDER BY date, rowid", id)
+	if err != nil {
+		return nil, err
+	}
+
+	hist := make([]StatusChange, 0)
+	for rows.Next() {
+		var chg StatusChange
+
+		err = rows.Scan(&chg.Status, &chg.Date)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		hist = append(hist, chg)
+	}
+	rows.Close()
+
+	return hist, nil
+}
+
 func FetchOrder(id int64, database *sql.DB) (Order, error) {
 	rows, err := database.Query("SELECT * FROM orders WHERE id = ?", id)
 
@@ -80,9 +260,45 @@ func FetchOrder(id int64, database *sql.DB) (Order, error) {
 }
 
 type Receipt struct {
-	Order Order
-	Cart  []CartItem
-	Sum   uint64
+	Order    Order          `json:"order"`
+	Cart     []CartItem     `json:"items"`
+	Subtotal uint64         `json:"subtotal"` // Sum of the item prices
+	Discount uint64         `json:"discount"` // Sum of the item discounts
+	Taxes    []TaxLine      `json:"taxes"`
+	Sum      uint64         `json:"sum"` // Total to pay, including tax and shipping
+	History  []StatusChange `json:"history"`
+	// Copies made when the order was placed, nil if none was given
+	Address        *Address `json:"address"`
+	BillingAddress *Address `json:"billingAddress"`
+}
+
+// Whether the order is billed to another address than it is shipped to.
+func (rcpt Receipt) SeparateBilling() bool {
+	if rcpt.BillingAddress == nil {
+		return false
+	}
+	return rcpt.Address == nil || *rcpt.Address != *rcpt.BillingAddress
+}
+
+// Fills in subtotal, discount, taxes and sum from the items and the shipping
+// of the order.
+func SumReceipt(rcpt Receipt) Receipt {
+	amounts := make([]TaxedAmount, 0)
+
+	rcpt.Subtotal = 0
+	rcpt.Discount = 0
+	for _, itm := range rcpt.Cart {
+		rcpt.Subtotal += itm.Product.Price * itm.Amount
+		rcpt.Discount += itm.Discount
+		amounts = append(amounts, TaxedAmount{itm.Product.Price*itm.Amount - itm.Discount, itm.TaxRate})
+	}
+
+	if rcpt.Order.Shipping.Price > 0 {
+		amounts = append(amounts, TaxedAmount{rcpt.Order.Shipping.Price, rcpt.Order.Shipping.TaxRate})
+	}
+
+	rcpt.Taxes, rcpt.Sum = ComputeTaxes(amounts, rcpt.Order.NetPrices)
+	return rcpt
 }
 
 func FetchReceipt(id int64, database *sql.DB) (Receipt, error) {
@@ -91,180 +307,477 @@ func FetchReceipt(id int64, database *sql.DB) (Receipt, error) {
 		return Receipt{}, err
 	}
 
-	rows, err := database.Query("SELECT products.id,products.name,products.slug,products.description,products.price,products.count,order_items.count as selected_count FROM order_items JOIN products ON products.id = order_items.product WHERE orderid = ?", id)
+	// Name and price are those at the time of the order, the product may have
+	// changed or be gone since
+	rows, err := database.Query("SELECT order_items.product,order_items.name,COALESCE(products.slug, ''),COALESCE(products.description, ''),order_items.price,COALESCE(products.count, 0),order_items.count,order_items.taxrate,order_items.variant,order_items.variantname,order_items.sku,order_items.discount FROM order_items LEFT JOIN products ON products.id = order_items.product WHERE orderid = ? ORDER BY order_items.rowid", id)
 	if err != nil {
 		return Receipt{}, err
 	}
 
-	var sum uint64
-	sum = 0
 	cart := make([]CartItem, 0)
 	for rows.Next() {
-		var name, slug, desc string
-		var id int64
-		var price, count, amount uint64
+		var name, slug, desc, varName, sku string
+		var id, varId int64
+		var price, count, amount, rate, discount uint64
 
-		err = rows.Scan(&id, &name, &slug, &desc, &price, &count, &amount)
+		err = rows.Scan(&id, &name, &slug, &desc, &price, &count, &amount, &rate, &varId, &varName, &sku, &discount)
 		prod := Product{Id: id, Name: name, Slug: slug, Description: desc, Price: price, Count: count}
-		itm := CartItem{Product: prod, Amount: amount, NextAmount: amount + 1, PrevAmount: amount - 1}
+		itm := CartItem{Product: prod, Amount: amount, TaxRate: rate, Discount: discount, NextAmount: amount + 1, PrevAmount: amount - 1}
+		if varId != 0 {
+			itm.Variant = &Variant{Id: varId, Product: id, Name: varName, SKU: sku}
+		}
 
 		if err != nil {
 			rows.Close()
 			return Receipt{}, err
 		}
 
-		sum += prod.Price * itm.Amount
 		cart = append(cart, itm)
 	}
 
 	rows.Close()
-	return Receipt{ord, cart, sum}, nil
+
+	hist, err := FetchStatusHistory(id, database)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	ship, bill, err := FetchOrderAddresses(id, database)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	return SumReceipt(Receipt{Order: ord, Cart: cart, History: hist, Address: ship, BillingAddress: bill}), nil
 }
 
-func PostNewOrder(session Session, member Member, w http.ResponseWriter, r *http.Request) {
-	if member.Id == 0 {
-		http.Error(w, "Please Login/Register first", 500)
-		return
+// Receipt of the order with the given UUID, i.e. payment reference.
+func FetchReceiptByUuid(uuid string, database *sql.DB) (Receipt, error) {
+	var id int64
+
+	err := database.QueryRow("SELECT id FROM orders WHERE uuid = ?", uuid).Scan(&id)
+	if err == sql.ErrNoRows {
+		return Receipt{}, errors.New("No such order")
+	} else if err != nil {
+		return Receipt{}, err
 	}
 
-	uu := uuid.NewRandom()
+	return FetchReceipt(id, database)
+}
 
-	DatabaseMutex.Lock()
-	var rows *sql.Rows
+// Choices made by the customer on checkout
+type Checkout struct {
+	Shipping       string   `json:"shipping"`       // Id of the shipping method, empty for the first available one
+	Address        int64    `json:"address"`        // Shipping address from the address book, 0 for none
+	NewAddress     *Address `json:"newAddress"`     // Entered on checkout, used instead of Address and added to the address book
+	BillingAddress int64    `json:"billingAddress"` // From the address book, 0 to bill to the shipping address
+	EMail          string   `json:"email"`          // Required for guests, ignored for members
+	Coupon         string   `json:"coupon"`         // Discount code, empty for none
+}
 
-	tx, err := Database.Begin()
+// The "address" field is the id of an address from the address book or "new"
+// to use the address in the "name", "street" etc. fields. "billing" is empty
+// or the id of the billing address.
+func CheckoutFromForm(form url.Values) (Checkout, error) {
+	checkout := Checkout{Shipping: form.Get("shipping"), EMail: strings.TrimSpace(form.Get("email")), Coupon: strings.TrimSpace(form.Get("coupon"))}
+
+	switch addr := form.Get("address"); addr {
+	case "":
+	case "new":
+		newAddr := AddressFromForm(form, "")
+		if !newAddr.Empty() {
+			checkout.NewAddress = &newAddr
+		}
+	default:
+		id, err := strconv.ParseInt(addr, 10, 64)
+		if err != nil {
+			return Checkout{}, NewStatusError(400, "Invalid address")
+		}
+		checkout.Address = id
+	}
+
+	if bill := form.Get("billing"); bill != "" {
+		id, err := strconv.ParseInt(bill, 10, 64)
+		if err != nil {
+			return Checkout{}, NewStatusError(400, "Invalid billing address")
+		}
+		checkout.BillingAddress = id
+	}
+
+	return checkout, nil
+}
+
+// Shipping and billing address chosen on checkout.
+func CheckoutAddresses(checkout Checkout, member Member, database *sql.DB) (*Address, *Address, error) {
+	var shipAddr, billAddr *Address
+
+	if checkout.NewAddress != nil {
+		addr := *checkout.NewAddress
+		addr.Id = 0
+		addr.Member = member.Id
+
+		err := CheckAddress(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		shipAddr = &addr
+	} else if checkout.Address != 0 {
+		addr, err := FetchMemberAddress(checkout.Address, member, database)
+		if err != nil {
+			return nil, nil, NewStatusError(400, "%s", err.Error())
+		}
+		shipAddr = &addr
+	}
+
+	if checkout.BillingAddress != 0 {
+		addr, err := FetchMemberAddress(checkout.BillingAddress, member, database)
+		if err != nil {
+			return nil, nil, NewStatusError(400, "%s", err.Error())
+		}
+		billAddr = &addr
+	}
+
+	return shipAddr, billAddr, nil
+}
+
+// Discount code of the checkout and all categories for ApplyCoupon. Returns
+// a nil coupon if no code was given.
+func CheckoutCoupon(code string, database *sql.DB) (*Coupon, []Category, error) {
+	if code == "" {
+		return nil, nil, nil
+	}
+
+	c, err := FetchCouponByCode(code, database)
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to order: "+err.Error(), 500)
-		return
+		return nil, nil, err
 	}
 
-	ord, err := NewOrder(member, uu.String(), tx)
+	cats, err := FetchCategories(database)
 	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to order: "+err.Error(), 500)
-		return
+		return nil, nil, err
+	}
+
+	return &c, cats, nil
+}
+
+// Turns the cart of the session into an order of the member, takes the items
+// out of stock and mails a confirmation. Guests need to give an email address
+// on checkout.
+func PlaceOrder(session Session, member Member, checkout Checkout, database *sql.DB) (Receipt, error) {
+	var email string
+	if member.Id == 0 {
+		if !IsEMail(checkout.EMail) {
+			return Receipt{}, NewStatusError(400, "Guests need to give an email address")
+		}
+		email = checkout.EMail
+	}
+
+	shipAddr, billAddr, err := CheckoutAddresses(checkout, member, database)
+	if err != nil {
+		return Receipt{}, err
 	}
 
-	rows, err = tx.Query("SELECT products.id,products.name,products.slug,products.description,products.price,products.count,carts.count as selected_count FROM carts JOIN products ON products.id = carts.product WHERE session = ?", session.Id)
+	coupon, cats, err := CheckoutCoupon(checkout.Coupon, database)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	sessId, memId := CartOwner(session)
+	rows, err := tx.Query(cartItemQuery, member.Group, member.Group, sessId, memId)
 	if err != nil {
 		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to order: "+err.Error(), 500)
-		return
+		return Receipt{}, err
 	}
 
-	var sum uint64
-	sum = 0
 	cart := make([]CartItem, 0)
 	for rows.Next() {
-		var name, slug, desc string
-		var id int64
-		var price, count, amount uint64
-
-		err = rows.Scan(&id, &name, &slug, &desc, &price, &count, &amount)
-		prod := Product{Id: id, Name: name, Slug: slug, Description: desc, Price: price, Count: count}
-		itm := CartItem{Product: prod, Amount: amount, NextAmount: amount + 1, PrevAmount: amount - 1}
-
+		itm, err := CartItemFromRow(rows, member.Group)
 		if err != nil {
 			rows.Close()
 			tx.Rollback()
-			DatabaseMutex.Unlock()
-			http.Error(w, "Failed to order: "+err.Error(), 500)
-			return
+			return Receipt{}, err
 		}
 
-		sum += prod.Price * itm.Amount
 		cart = append(cart, itm)
 	}
+	rows.Close()
 
-	for _, c := range cart {
-		_, err = tx.Exec("INSERT INTO order_items VALUES ( ?, ?, ? )", ord.Id, c.Product.Id, c.Amount)
+	if len(cart) == 0 {
+		tx.Rollback()
+		return Receipt{}, NewStatusError(400, "empty cart")
+	}
+
+	if coupon != nil {
+		cart, err = ApplyCoupon(*coupon, cart, cats)
 		if err != nil {
 			tx.Rollback()
-			DatabaseMutex.Unlock()
-			http.Error(w, "Failed to order: "+err.Error(), 500)
-			return
+			return Receipt{}, err
 		}
 	}
 
-	if len(cart) == 0 {
+	ship, err := SelectShipping(checkout.Shipping, cart)
+	if err != nil {
 		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to order: empty cart", 500)
-		return
+		return Receipt{}, err
 	}
 
-	_, err = tx.Exec("DELETE FROM carts WHERE session = ?", session.Id)
+	if shipAddr == nil && ShippingNeedsAddress(ship.Method) {
+		tx.Rollback()
+		return Receipt{}, NewStatusError(400, "%s needs a shipping address", ship.Name)
+	}
+
+	ord, err := NewOrder(member, uuid.NewRandom().String(), ship, email, coupon, tx)
 	if err != nil {
 		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to order: "+err.Error(), 500)
-		return
+		return Receipt{}, err
+	}
+
+	if shipAddr != nil {
+		err = SaveOrderAddress(ord.Id, "shipping", *shipAddr, tx)
+		if err != nil {
+			tx.Rollback()
+			return Receipt{}, err
+		}
+	}
+
+	if billAddr != nil {
+		err = SaveOrderAddress(ord.Id, "billing", *billAddr, tx)
+		if err != nil {
+			tx.Rollback()
+			return Receipt{}, err
+		}
+	} else {
+		billAddr = shipAddr
+	}
+
+	for _, c := range cart {
+		var varId int64
+		var varName, sku string
+		if c.Variant != nil {
+			varId, varName, sku = c.Variant.Id, c.Variant.Name, c.Variant.SKU
+		}
+
+		avail, err := AvailableCount(c.Product.Id, varId, session, tx)
+		if err != nil {
+			tx.Rollback()
+			return Receipt{}, err
+		}
+
+		if avail < c.Amount {
+			tx.Rollback()
+			return Receipt{}, NewStatusError(400, "not enough %s in stock", c.Name())
+		}
+
+		_, err = tx.Exec("INSERT INTO order_items VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ? )", ord.Id, c.Product.Id, c.Amount, c.Product.Name, c.Product.Price, c.TaxRate, varId, varName, sku, c.Discount)
+		if err != nil {
+			tx.Rollback()
+			return Receipt{}, err
+		}
+
+		if c.Variant != nil {
+			_, err = tx.Exec("UPDATE variants SET count = count - ? WHERE id = ?", c.Amount, varId)
+		} else {
+			_, err = tx.Exec("UPDATE products SET count = count - ? WHERE id = ?", c.Amount, c.Product.Id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return Receipt{}, err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM carts WHERE session = ? AND member = ?", sessId, memId)
+	if err != nil {
+		tx.Rollback()
+		return Receipt{}, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed add to cart: "+err.Error(), 500)
+		return Receipt{}, err
+	}
+
+	// The order has its own copy, so failing to remember the address for the
+	// next time is no reason to fail the order
+	if checkout.NewAddress != nil && member.Id != 0 {
+		_, err = InsertAddress(*shipAddr, database)
+		if err != nil {
+			log.Println("Failed to add address to the address book: " + err.Error())
+		}
+	}
+
+	rcpt := SumReceipt(Receipt{Order: ord, Cart: cart, History: []StatusChange{{ord.Status, ord.Date}}, Address: shipAddr, BillingAddress: billAddr})
+
+	mail := struct {
+		Member    Member
+		Uuid      string
+		Sum       uint64
+		Cart      []CartItem
+		Subtotal  uint64
+		Discount  uint64
+		Coupon    string
+		Taxes     []TaxLine
+		NetPrices bool
+		Shipping  Shipping
+		Address   *Address
+	}{
+		member,
+		ord.Uuid,
+		rcpt.Sum,
+		cart,
+		rcpt.Subtotal,
+		rcpt.Discount,
+		ord.Coupon,
+		rcpt.Taxes,
+		ord.NetPrices,
+		ord.Shipping,
+		rcpt.Address,
+	}
+
+	png, err := PaymentQRCode(ord.Uuid, rcpt.Sum)
+	if err != nil {
+		log.Println("Failed to create payment QR code: " + err.Error())
+		SendMail(ord.ContactEMail(member), "mails/order", mail)
+	} else {
+		SendMail(ord.ContactEMail(member), "mails/order", mail, MailAttachment{"girocode.png", "image/png", png})
+	}
+
+	return rcpt, nil
+}
+
+func PostNewOrder(session Session, member Member, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed parse <form>: "+err.Error(), 500)
+		return
+	}
+
+	checkout, err := CheckoutFromForm(r.PostForm)
+	if err != nil {
+		http.Error(w, "Failed to order: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
+	DatabaseMutex.Lock()
+	rcpt, err := PlaceOrder(session, member, checkout, Database)
 	DatabaseMutex.Unlock()
 
+	if err != nil {
+		http.Error(w, "Failed to order: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
 	meta := struct {
-		Uuid uuid.UUID
-		Sum  uint64
+		Uuid      string
+		Sum       uint64
+		Subtotal  uint64
+		Discount  uint64
+		Coupon    string
+		Taxes     []TaxLine
+		NetPrices bool
+		Shipping  Shipping
+		Guest     bool
 	}{
-		uu,
-		sum,
+		rcpt.Order.Uuid,
+		rcpt.Sum,
+		rcpt.Subtotal,
+		rcpt.Discount,
+		rcpt.Order.Coupon,
+		rcpt.Taxes,
+		rcpt.Order.NetPrices,
+		rcpt.Order.Shipping,
+		member.Id == 0,
 	}
 
-	RenderTemplate(w, "orders/success", "", member, meta)
+	RenderTemplate(w, r, "orders/success", "", member, meta)
 }
 
+// Shows the cart with the totals for the shipping method and discount code
+// chosen in the query, or the first available method. Codes that can't be
+// used are reported on the page.
 func GetNewOrder(session Session, member Member, w http.ResponseWriter, r *http.Request) {
-	DatabaseMutex.Lock()
+	code := strings.TrimSpace(r.URL.Query().Get("coupon"))
 
-	var rows *sql.Rows
-	rows, err := Database.Query("SELECT products.id,products.name,products.slug,products.description,products.price,products.count,carts.count as selected_count FROM carts JOIN products ON products.id = carts.product WHERE session = ?", session.Id)
+	DatabaseMutex.Lock()
+	cart, err := FetchCart(session, member, Database)
+	var addrs []Address
+	if err == nil {
+		addrs, err = FetchAddresses(member.Id, Database)
+	}
+	var coupon *Coupon
+	var cats []Category
+	var couponErr error
+	if err == nil {
+		coupon, cats, couponErr = CheckoutCoupon(code, Database)
+	}
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		DatabaseMutex.Unlock()
 		http.Error(w, "Failed fetch cart: "+err.Error(), 500)
 		return
 	}
 
-	var sum uint64
-	sum = 0
-	cart := make([]CartItem, 0)
-	for rows.Next() {
-		var name, slug, desc string
-		var id int64
-		var price, count, amount uint64
-
-		err := rows.Scan(&id, &name, &slug, &desc, &price, &count, &amount)
-		prod := Product{Id: id, Name: name, Slug: slug, Description: desc, Price: price, Count: count}
-		itm := CartItem{Product: prod, Amount: amount, NextAmount: amount + 1, PrevAmount: amount - 1}
+	if coupon != nil && len(cart) > 0 {
+		var discounted []CartItem
+		discounted, couponErr = ApplyCoupon(*coupon, cart, cats)
+		if couponErr == nil {
+			cart = discounted
+			code = coupon.Code
+		}
+	}
 
-		if err == nil {
-			sum += prod.Price * itm.Amount
-			cart = append(cart, itm)
+	var couponMsg string
+	if couponErr != nil {
+		if ErrorStatus(couponErr) != 400 {
+			http.Error(w, "Failed to fetch discount code: "+couponErr.Error(), 500)
+			return
 		}
+		couponMsg = couponErr.Error()
+		code = ""
 	}
 
-	DatabaseMutex.Unlock()
+	ship, err := SelectShipping(r.URL.Query().Get("shipping"), cart)
+	if err != nil && len(cart) > 0 {
+		http.Error(w, "Failed to select shipping: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	rcpt := SumReceipt(Receipt{Order: Order{NetPrices: GlobalConfig.Tax.NetPrices, Shipping: ship}, Cart: cart})
 
 	meta := struct {
-		Cart []CartItem
-		Sum  uint64
+		Cart         []CartItem
+		Subtotal     uint64
+		Discount     uint64
+		Coupon       string // Code that was applied
+		CouponError  string
+		Taxes        []TaxLine
+		Sum          uint64
+		NetPrices    bool
+		Shipping     Shipping
+		Options      []ShippingOption
+		Addresses    []Address
+		NeedsAddress bool
+		Guest        bool
 	}{
 		cart,
-		sum,
+		rcpt.Subtotal,
+		rcpt.Discount,
+		code,
+		couponMsg,
+		rcpt.Taxes,
+		rcpt.Sum,
+		rcpt.Order.NetPrices,
+		ship,
+		ShippingOptions(cart),
+		addrs,
+		ShippingNeedsAddress(ship.Method),
+		member.Id == 0,
 	}
 
-	RenderTemplate(w, "orders/new", "", member, meta)
+	RenderTemplate(w, r, "orders/new", "", member, meta)
 
 }
 
@@ -291,144 +804,219 @@ func HandleOrdersNew(w http.ResponseWriter, r *http.Request) {
 }
 
 type NamedReceipt struct {
-	Receipt Receipt
-	Member  Member
+	Receipt Receipt `json:"receipt"`
+	Member  Member  `json:"member"`
 }
 
-func GetOrders(mem Member, w http.ResponseWriter, r *http.Request) {
-	DatabaseMutex.Lock()
-	rows, err := Database.Query("SELECT id,member FROM orders")
-
+// All orders together with the members that placed them.
+func FetchNamedReceipts(database *sql.DB) ([]NamedReceipt, error) {
+	rows, err := database.Query("SELECT id,member FROM orders")
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, err
 	}
 
-	rcpts := make([]NamedReceipt, 0)
+	ids := make([][2]int64, 0)
 	for rows.Next() {
 		var id, memId int64
 
 		err := rows.Scan(&id, &memId)
 		if err != nil {
 			rows.Close()
-			DatabaseMutex.Unlock()
-			http.Error(w, err.Error(), 500)
-			return
+			return nil, err
 		}
 
-		rcpt, err := FetchReceipt(id, Database)
+		ids = append(ids, [2]int64{id, memId})
+	}
+	rows.Close()
 
+	rcpts := make([]NamedReceipt, 0)
+	for _, id := range ids {
+		rcpt, err := FetchReceipt(id[0], database)
 		if err != nil {
-			rows.Close()
-			DatabaseMutex.Unlock()
-			http.Error(w, err.Error(), 500)
-			return
+			return nil, err
 		}
 
-		rec_mem, err := FetchMember(memId, Database)
+		rec_mem, err := FetchMember(id[1], database)
+		if err != nil {
+			return nil, err
+		}
 
+		rcpts = append(rcpts, NamedReceipt{Receipt: rcpt, Member: rec_mem})
+	}
+
+	return rcpts, nil
+}
+
+func FetchMemberReceipts(memId int64, database *sql.DB) ([]Receipt, error) {
+	rows, err := database.Query("SELECT id FROM orders WHERE member = ?", memId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
 		if err != nil {
 			rows.Close()
-			DatabaseMutex.Unlock()
-			http.Error(w, err.Error(), 500)
-			return
+			return nil, err
 		}
 
-		rcpts = append(rcpts, NamedReceipt{Receipt: rcpt, Member: rec_mem})
+		ids = append(ids, id)
 	}
+	rows.Close()
+
+	orders := make([]Receipt, 0)
+	for _, id := range ids {
+		ord, err := FetchReceipt(id, database)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, ord)
+	}
+
+	return orders, nil
+}
 
+func GetOrders(mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	rcpts, err := FetchNamedReceipts(Database)
 	DatabaseMutex.Unlock()
-	RenderTemplate(w, "orders/list", "", mem, rcpts)
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderTemplate(w, r, "orders/list", "", mem, rcpts)
 }
 
-func PutOrder(rcpt Receipt, w http.ResponseWriter, r *http.Request) {
+// Moves the order to status and notifies its owner.
+func ChangeOrderStatus(rcpt Receipt, status string, database *sql.DB) (Receipt, error) {
+	err := CheckStatusTransition(rcpt.Order.Status, status)
+	if err != nil {
+		return Receipt{}, NewStatusError(400, "%s", err.Error())
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	err = SetOrderStatus(rcpt, status, tx)
+	if err != nil {
+		tx.Rollback()
+		return Receipt{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	rcpt, err = FetchReceipt(rcpt.Order.Id, database)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	owner, err := FetchMember(rcpt.Order.Member, database)
+	if err == nil {
+		mail := struct {
+			Member  Member
+			Receipt Receipt
+		}{
+			owner,
+			rcpt,
+		}
+
+		SendMail(rcpt.Order.ContactEMail(owner), "mails/status", mail)
+	}
+
+	return rcpt, nil
+}
+
+func PutOrder(rcpt Receipt, mem Member, w http.ResponseWriter, r *http.Request) {
 	stats, ok := r.PostForm["status"]
-	if !ok || len(stats) != 1 || (stats[0] != "new" && stats[0] != "paid") {
-		http.Error(w, "Missing or invalid status", 500)
+	if !ok || len(stats) != 1 {
+		http.Error(w, "Missing status", 400)
+		return
+	}
+
+	if !CanSetOrderStatus(mem, stats[0]) {
+		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
 
 	DatabaseMutex.Lock()
-	_, err := Database.Exec("UPDATE orders SET status = ? WHERE id = ?", stats[0], rcpt.Order.Id)
+	_, err := ChangeOrderStatus(rcpt, stats[0], Database)
 	DatabaseMutex.Unlock()
 
 	if err != nil {
-		http.Error(w, "Failed to update order: "+err.Error(), 500)
-	} else {
-		http.Redirect(w, r, "/orders/", 301)
+		http.Error(w, "Failed to update order: "+err.Error(), ErrorStatus(err))
+		return
 	}
+
+	http.Redirect(w, r, "/orders/", 301)
 }
 
-func DeleteOrder(rcpt Receipt, w http.ResponseWriter, r *http.Request) {
-	DatabaseMutex.Lock()
-	tx, err := Database.Begin()
+// Deletes the order. Items that are still in the shop go back into stock,
+// payments recorded for the order are kept for review.
+func RemoveOrder(rcpt Receipt, database *sql.DB) error {
+	tx, err := database.Begin()
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to delete order: "+err.Error(), 500)
-		return
+		return err
 	}
 
-	for _, itm := range rcpt.Cart {
-		rows, err := tx.Query("SELECT count FROM products WHERE id = ?", itm.Product.Id)
+	// Only orders that haven't left the shop go back into stock, unless that
+	// happened already when they were cancelled or refunded
+	if !rcpt.Order.Restocked && !rcpt.LeftShop() {
+		err = RestockOrder(rcpt, tx)
 		if err != nil {
 			tx.Rollback()
-			DatabaseMutex.Unlock()
-			http.Error(w, "Failed to delete order: "+err.Error(), 500)
-			return
-		}
-
-		if !rows.Next() {
-			tx.Rollback()
-			DatabaseMutex.Unlock()
-			http.Error(w, "Failed to delete order: ordered non-existing product", 500)
-			return
+			return err
 		}
+	}
 
-		var count uint64
-		err = rows.Scan(&count)
-		if err != nil {
-			tx.Rollback()
-			DatabaseMutex.Unlock()
-			http.Error(w, "Failed to delete order: "+err.Error(), 500)
-			return
-		}
+	// Payments for the order go back to the review list
+	_, err = tx.Exec("UPDATE bank_transactions SET orderid = 0, result = 'deleted', reviewed = 0 WHERE orderid = ?", rcpt.Order.Id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
-		rows.Close()
-		count += itm.Amount
-		_, err = tx.Exec("UPDATE products SET count = ? WHERE id = ?", count, itm.Product.Id)
+	for _, stmt := range []string{
+		"DELETE FROM order_items WHERE orderid = ?",
+		"DELETE FROM order_status_history WHERE orderid = ?",
+		"DELETE FROM order_addresses WHERE orderid = ?",
+		"DELETE FROM orders WHERE id = ?",
+	} {
+		_, err = tx.Exec(stmt, rcpt.Order.Id)
 		if err != nil {
 			tx.Rollback()
-			DatabaseMutex.Unlock()
-			http.Error(w, "Failed to delete order: "+err.Error(), 500)
-			return
+			return err
 		}
 	}
 
-	_, err = tx.Exec("DELETE FROM order_items WHERE orderid = ?", rcpt.Order.Id)
-	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to delete order: "+err.Error(), 500)
-		return
-	}
+	return tx.Commit()
+}
 
-	_, err = tx.Exec("DELETE FROM orders WHERE id = ?", rcpt.Order.Id)
-	if err != nil {
-		tx.Rollback()
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed to delete order: "+err.Error(), 500)
+func DeleteOrder(rcpt Receipt, mem Member, w http.ResponseWriter, r *http.Request) {
+	if !HasPermission(mem, "orders.delete") {
+		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
 
-	err = tx.Commit()
+	DatabaseMutex.Lock()
+	err := RemoveOrder(rcpt, Database)
+	DatabaseMutex.Unlock()
+
 	if err != nil {
-		DatabaseMutex.Unlock()
-		http.Error(w, "Failed delete order: "+err.Error(), 500)
+		http.Error(w, "Failed to delete order: "+err.Error(), 500)
 		return
 	}
 
-	DatabaseMutex.Unlock()
 	http.Redirect(w, r, "/orders/", 301)
 }
 
@@ -443,7 +1031,8 @@ func HandleOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if mem.Group != "admin" {
+	// Everything here needs "orders.view", changes need more permissions
+	if !HasPermission(mem, "orders.view") {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
@@ -489,9 +1078,9 @@ func HandleOrder(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if meth == "PUT" {
-			PutOrder(rcpt, w, r)
+			PutOrder(rcpt, mem, w, r)
 		} else if meth == "DELETE" {
-			DeleteOrder(rcpt, w, r)
+			DeleteOrder(rcpt, mem, w, r)
 		} else {
 			http.Error(w, "Not found", 404)
 		}
@@ -522,39 +1111,13 @@ func GetMyOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := Database.Query("SELECT id FROM orders WHERE member = ?", mem.Id)
+	orders, err := FetchMemberReceipts(mem.Id, Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		DatabaseMutex.Unlock()
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	orders := make([]Receipt, 0)
-	for rows.Next() {
-		var id int64
-
-		err := rows.Scan(&id)
-		if err != nil {
-			rows.Close()
-			DatabaseMutex.Unlock()
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		ord, err := FetchReceipt(id, Database)
-
-		if err != nil {
-			rows.Close()
-			DatabaseMutex.Unlock()
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
-		orders = append(orders, ord)
-	}
-
-	DatabaseMutex.Unlock()
-
-	RenderTemplate(w, "orders/my", "", mem, orders)
+	RenderTemplate(w, r, "orders/my", "", mem, orders)
 }
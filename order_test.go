@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestCheckStatusTransition(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		ok   bool
+	}{
+		{"new", "paid", true},
+		{"new", "cancelled", true},
+		{"new", "packed", false},
+		{"new", "shipped", false},
+		{"new", "refunded", false},
+		{"paid", "packed", true},
+		{"paid", "picked-up", true},
+		{"paid", "refunded", true},
+		{"paid", "shipped", false},
+		{"paid", "cancelled", false},
+		{"paid", "new", false},
+		{"packed", "shipped", true},
+		{"packed", "picked-up", true},
+		{"packed", "refunded", true},
+		{"packed", "paid", false},
+		{"packed", "cancelled", false},
+		{"shipped", "refunded", true},
+		{"shipped", "picked-up", false},
+		{"shipped", "cancelled", false},
+		{"picked-up", "refunded", true},
+		{"picked-up", "shipped", false},
+		{"cancelled", "new", false},
+		{"cancelled", "paid", false},
+		{"refunded", "paid", false},
+		{"refunded", "cancelled", false},
+		{"new", "new", false},
+		{"paid", "paid", false},
+		{"new", "lost", false},
+		{"new", "", false},
+		{"lost", "paid", false},
+		{"", "new", false},
+	}
+
+	for _, tt := range tests {
+		err := CheckStatusTransition(tt.from, tt.to)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckStatusTransition(%q, %q) = %v, want ok %v", tt.from, tt.to, err, tt.ok)
+		}
+	}
+}
+
+func TestOrderTransitions(t *testing.T) {
+	for from, next := range OrderTransitions {
+		if _, ok := OrderStatusNames[from]; !ok {
+			t.Errorf("Transitions from unknown status '%s'", from)
+		}
+		for _, to := range next {
+			if _, ok := OrderStatusNames[to]; !ok {
+				t.Errorf("Transition from '%s' to unknown status '%s'", from, to)
+			}
+		}
+	}
+
+	for status := range OrderStatusNames {
+		if _, ok := OrderTransitions[status]; !ok {
+			t.Errorf("No transitions for status '%s'", status)
+		}
+	}
+}
+
+func TestRestocksOnStatus(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{"new", "cancelled", true},
+		{"paid", "refunded", true},
+		{"packed", "refunded", true},
+		{"shipped", "refunded", false},
+		{"picked-up", "refunded", false},
+		{"new", "paid", false},
+		{"paid", "packed", false},
+		{"packed", "shipped", false},
+		{"packed", "picked-up", false},
+	}
+
+	for _, tt := range tests {
+		if got := RestocksOnStatus(tt.from, tt.to); got != tt.want {
+			t.Errorf("RestocksOnStatus(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestLeftShop(t *testing.T) {
+	tests := []struct {
+		name string
+		hist []string
+		want bool
+	}{
+		{"new", []string{"new"}, false},
+		{"packed", []string{"new", "paid", "packed"}, false},
+		{"refunded before shipping", []string{"new", "paid", "packed", "refunded"}, false},
+		{"shipped", []string{"new", "paid", "packed", "shipped"}, true},
+		{"refunded after shipping", []string{"new", "paid", "packed", "shipped", "refunded"}, true},
+		{"refunded after pickup", []string{"new", "paid", "picked-up", "refunded"}, true},
+	}
+
+	for _, tt := range tests {
+		var rcpt Receipt
+		for i, s := range tt.hist {
+			rcpt.History = append(rcpt.History, StatusChange{s, int64(i)})
+		}
+		if got := rcpt.LeftShop(); got != tt.want {
+			t.Errorf("%s: LeftShop() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"strings"
+)
+
+// Stored password hashes are modular crypt strings that carry algorithm,
+// parameters and a per-member salt:
+//
+//   $argon2id$v=19$m=<memory KiB>,t=<time>,p=<threads>$<salt>$<hash>
+//   $pbkdf2-sha256$<iterations>$<salt>$<hash>
+//   $2a$<cost>$<salt and hash>   (bcrypt)
+//
+// Salt and hash are unpadded base64. Hashes written before this format
+// existed are 64 hex digits, PBKDF2-SHA256 with 8192 iterations salted with
+// GlobalConfig.Salt. All of them are accepted on login and replaced by a hash
+// with the current parameters.
+
+// Parameters for new password hashes
+const (
+	PasswordSaltLength     = 16
+	PasswordKeyLength      = 32
+	Argon2Time             = 1
+	Argon2Memory           = 64 * 1024
+	Argon2Threads          = 4
+	PBKDF2Iterations       = 100000
+	LegacyPBKDF2Iterations = 8192
+	BcryptCost             = 12
+)
+
+var b64 = base64.RawStdEncoding
+
+// Algorithm used for new hashes, configurable via "passwordHash".
+func PasswordAlgorithm() string {
+	if GlobalConfig.PasswordHash == "" {
+		return "argon2id"
+	}
+	return GlobalConfig.PasswordHash
+}
+
+func CheckPasswordAlgorithm(algo string) error {
+	switch algo {
+	case "", "argon2id", "bcrypt", "pbkdf2-sha256":
+		return nil
+	default:
+		return errors.New("Unknown password hash algorithm '" + algo + "'")
+	}
+}
+
+func HashPassword(passwd string) (string, error) {
+	algo := PasswordAlgorithm()
+
+	if algo == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passwd), BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, PasswordSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	switch algo {
+	case "argon2id":
+		key := argon2.IDKey([]byte(passwd), salt, Argon2Time, Argon2Memory, Argon2Threads, PasswordKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, Argon2Memory, Argon2Time, Argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case "pbkdf2-sha256":
+		key := pbkdf2.Key([]byte(passwd), salt, PBKDF2Iterations, PasswordKeyLength, sha256.New)
+		return fmt.Sprintf("$pbkdf2-sha256$%d$%s$%s", PBKDF2Iterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	default:
+		return "", errors.New("Unknown password hash algorithm '" + algo + "'")
+	}
+}
+
+// Checks passwd against the stored hash. rehash is true if the password is
+// correct but the hash does not use the current algorithm and parameters.
+func VerifyPassword(passwd string, hash string) (ok bool, rehash bool) {
+	algo := PasswordAlgorithm()
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		var version, mem, time uint32
+		var threads uint8
+
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+
+		_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+		if err != nil || version != argon2.Version {
+			return false, false
+		}
+
+		_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &time, &threads)
+		if err != nil {
+			return false, false
+		}
+
+		salt, err := b64.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+
+		key, err := b64.DecodeString(parts[5])
+		if err != nil || len(key) == 0 {
+			return false, false
+		}
+
+		cmp := argon2.IDKey([]byte(passwd), salt, time, mem, threads, uint32(len(key)))
+		ok = subtle.ConstantTimeCompare(key, cmp) == 1
+		rehash = algo != "argon2id" || mem != Argon2Memory || time != Argon2Time || threads != Argon2Threads || len(salt) != PasswordSaltLength || len(key) != PasswordKeyLength
+
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		var iter int
+
+		parts := strings.Split(hash, "$")
+		if len(parts) != 5 {
+			return false, false
+		}
+
+		_, err := fmt.Sscanf(parts[2], "%d", &iter)
+		if err != nil || iter <= 0 {
+			return false, false
+		}
+
+		salt, err := b64.DecodeString(parts[3])
+		if err != nil {
+			return false, false
+		}
+
+		key, err := b64.DecodeString(parts[4])
+		if err != nil || len(key) == 0 {
+			return false, false
+		}
+
+		cmp := pbkdf2.Key([]byte(passwd), salt, iter, len(key), sha256.New)
+		ok = subtle.ConstantTimeCompare(key, cmp) == 1
+		rehash = algo != "pbkdf2-sha256" || iter != PBKDF2Iterations || len(salt) != PasswordSaltLength || len(key) != PasswordKeyLength
+
+	case strings.HasPrefix(hash, "$2"):
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd)) == nil
+
+		cost, err := bcrypt.Cost([]byte(hash))
+		rehash = algo != "bcrypt" || err != nil || cost != BcryptCost
+
+	case len(hash) == 2*PasswordKeyLength:
+		key, err := hex.DecodeString(hash)
+		if err != nil {
+			return false, false
+		}
+
+		cmp := pbkdf2.Key([]byte(passwd), []byte(GlobalConfig.Salt), LegacyPBKDF2Iterations, PasswordKeyLength, sha256.New)
+		ok = subtle.ConstantTimeCompare(key, cmp) == 1
+		rehash = true
+
+	default:
+		return false, false
+	}
+
+	return ok, ok && rehash
+}
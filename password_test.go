@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func withPasswordConfig(algo string, salt string) func() {
+	old := GlobalConfig
+	GlobalConfig.PasswordHash = algo
+	GlobalConfig.Salt = salt
+	return func() { GlobalConfig = old }
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, algo := range []string{"argon2id", "pbkdf2-sha256", "bcrypt"} {
+		restore := withPasswordConfig(algo, "")
+
+		hash, err := HashPassword("correct horse")
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+
+		prefix := "$" + algo + "$"
+		if algo == "bcrypt" {
+			prefix = "$2"
+		}
+		if !strings.HasPrefix(hash, prefix) {
+			t.Errorf("%s: hash %q doesn't start with %q", algo, hash, prefix)
+		}
+
+		other, err := HashPassword("correct horse")
+		if err != nil || other == hash {
+			t.Errorf("%s: hashing twice gave the same hash, salt missing", algo)
+		}
+
+		tests := []struct {
+			passwd string
+			ok     bool
+		}{
+			{"correct horse", true},
+			{"correct hors", false},
+			{"Correct horse", false},
+			{"", false},
+		}
+		for _, tt := range tests {
+			ok, rehash := VerifyPassword(tt.passwd, hash)
+			if ok != tt.ok || rehash {
+				t.Errorf("%s: VerifyPassword(%q) = %v, %v, want %v, false", algo, tt.passwd, ok, rehash, tt.ok)
+			}
+		}
+
+		restore()
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	defer withPasswordConfig("pbkdf2-sha256", "seems legit...")()
+
+	tests := []struct {
+		name   string
+		passwd string
+		hash   string
+		ok     bool
+		rehash bool
+	}{
+		{"current parameters", "hunter22", "$pbkdf2-sha256$100000$MDEyMzQ1Njc4OWFiY2RlZg$pDcRq8YoqQDvkDCvlxj/yBFVBSuTzs26CfNgqLWiGNE", true, false},
+		{"wrong password", "hunter23", "$pbkdf2-sha256$100000$MDEyMzQ1Njc4OWFiY2RlZg$pDcRq8YoqQDvkDCvlxj/yBFVBSuTzs26CfNgqLWiGNE", false, false},
+		{"old iteration count", "hunter22", "$pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", true, true},
+		{"old iteration count, wrong password", "hunter23", "$pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", false, false},
+		{"legacy hex hash", "adminadmin", "574262a792d69f26cbcffbac17b7be317d21aadb1f1abdf42a858af182ba8d71", true, true},
+		{"legacy hex hash, wrong password", "adminadmim", "574262a792d69f26cbcffbac17b7be317d21aadb1f1abdf42a858af182ba8d71", false, false},
+		{"legacy hash, not hex", "adminadmin", strings.Repeat("z", 64), false, false},
+		{"legacy hash, too short", "adminadmin", "574262a792d69f26cbcffbac17b7be317d21aadb1f1abdf42a858af182ba8d7", false, false},
+		{"empty hash", "", "", false, false},
+		{"pbkdf2, missing key", "hunter22", "$pbkdf2-sha256$100000$MDEyMzQ1Njc4OWFiY2RlZg", false, false},
+		{"pbkdf2, empty key", "hunter22", "$pbkdf2-sha256$100000$MDEyMzQ1Njc4OWFiY2RlZg$", false, false},
+		{"pbkdf2, zero iterations", "hunter22", "$pbkdf2-sha256$0$MDEyMzQ1Njc4OWFiY2RlZg$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", false, false},
+		{"pbkdf2, bad base64", "hunter22", "$pbkdf2-sha256$1000$!!!$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", false, false},
+		{"argon2id, wrong version", "hunter22", "$argon2id$v=16$m=65536,t=1,p=4$MDEyMzQ1Njc4OWFiY2RlZg$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", false, false},
+		{"argon2id, missing parameters", "hunter22", "$argon2id$v=19$MDEyMzQ1Njc4OWFiY2RlZg$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", false, false},
+		{"unknown algorithm", "hunter22", "$scrypt$MDEyMzQ1Njc4OWFiY2RlZg$ueBbYQVkDHSR2wInfuEbu55EoAdDx3ozbiXKophExIU", false, false},
+	}
+
+	for _, tt := range tests {
+		ok, rehash := VerifyPassword(tt.passwd, tt.hash)
+		if ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+}
+
+func TestVerifyPasswordAlgorithmChange(t *testing.T) {
+	restore := withPasswordConfig("argon2id", "")
+	hash, err := HashPassword("hunter22")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer withPasswordConfig("pbkdf2-sha256", "")()
+
+	if ok, rehash := VerifyPassword("hunter22", hash); !ok || !rehash {
+		t.Errorf("argon2id hash with pbkdf2-sha256 configured: got %v, %v, want true, true", ok, rehash)
+	}
+	if ok, rehash := VerifyPassword("hunter23", hash); ok || rehash {
+		t.Errorf("wrong password: got %v, %v, want false, false", ok, rehash)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"math/big"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Account customers transfer the order sum to
+type PaymentConfiguration struct {
+	Beneficiary string // Account holder
+	IBAN        string
+	BIC         string // Optional
+	Bank        string // Name of the bank, only shown to customers
+}
+
+// Size of the QR code images in pixels
+const PaymentQRSize = 256
+
+func CheckPaymentConfiguration(cfg PaymentConfiguration) error {
+	if cfg.Beneficiary == "" || utf8.RuneCountInString(cfg.Beneficiary) > 70 {
+		return errors.New("Payment beneficiary must be 1 to 70 characters long")
+	}
+
+	iban := strings.ToUpper(strings.Replace(cfg.IBAN, " ", "", -1))
+	if len(iban) < 15 || len(iban) > 34 {
+		return errors.New("Invalid payment IBAN '" + cfg.IBAN + "'")
+	}
+
+	// ISO 13616 check digits: move the first four characters to the end,
+	// replace letters by numbers and compute modulo 97
+	num := ""
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= '0' && c <= '9' {
+			num += string(c)
+		} else if c >= 'A' && c <= 'Z' {
+			num += fmt.Sprintf("%d", c-'A'+10)
+		} else {
+			return errors.New("Invalid payment IBAN '" + cfg.IBAN + "'")
+		}
+	}
+
+	n, _ := new(big.Int).SetString(num, 10)
+	if new(big.Int).Mod(n, big.NewInt(97)).Int64() != 1 {
+		return errors.New("Invalid check digits in payment IBAN '" + cfg.IBAN + "'")
+	}
+
+	if cfg.BIC != "" && len(cfg.BIC) != 8 && len(cfg.BIC) != 11 {
+		return errors.New("Invalid payment BIC '" + cfg.BIC + "'")
+	}
+
+	return nil
+}
+
+// The IBAN in groups of four characters.
+func FormatIBAN(iban string) string {
+	iban = strings.ToUpper(strings.Replace(iban, " ", "", -1))
+
+	groups := make([]string, 0)
+	for len(iban) > 4 {
+		groups = append(groups, iban[:4])
+		iban = iban[4:]
+	}
+
+	return strings.Join(append(groups, iban), " ")
+}
+
+func PaymentAccount() PaymentConfiguration {
+	return GlobalConfig.Payment
+}
+
+// Credit transfer of sum with the order UUID as remittance information,
+// encoded as defined by EPC069-12 ("GiroCode") version 002.
+func EPCPayload(uuid string, sum uint64) (string, error) {
+	cfg := GlobalConfig.Payment
+
+	if sum < 1 || sum > 99999999999 {
+		return "", fmt.Errorf("Amount %s EUR can't be paid by credit transfer", FormatMoney(sum))
+	}
+
+	lines := []string{
+		"BCD",
+		"002",
+		"1", // UTF-8
+		"SCT",
+		cfg.BIC,
+		cfg.Beneficiary,
+		strings.ToUpper(strings.Replace(cfg.IBAN, " ", "", -1)),
+		fmt.Sprintf("EUR%d.%02d", sum/100, sum%100),
+		"", // Purpose
+		"", // Structured reference
+		uuid,
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// PNG image of the EPC QR code for paying the order.
+func PaymentQRCode(uuid string, sum uint64) ([]byte, error) {
+	payload, err := EPCPayload(uuid, sum)
+	if err != nil {
+		return nil, err
+	}
+
+	// EPC069-12 requires error correction level M
+	return qrcode.Encode(payload, qrcode.Medium, PaymentQRSize)
+}
+
+// Serves the QR code of the order with the UUID in the path. The UUID is
+// what the customer was told to use as reference, so the endpoint works
+// without a session, e.g. when embedded in mails.
+func HandlePaymentQRCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	uuid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orders/qr/"), ".png")
+
+	DatabaseMutex.Lock()
+	rcpt, err := FetchReceiptByUuid(uuid, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	if rcpt.Order.Status != "new" {
+		http.Error(w, "Order is not awaiting payment", 410)
+		return
+	}
+
+	png, err := PaymentQRCode(rcpt.Order.Uuid, rcpt.Sum)
+	if err != nil {
+		http.Error(w, "Failed to create QR code: "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write(png)
+}
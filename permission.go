@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// Permissions member groups can be granted. The built-in "admin" group has
+// all of them, "customer" none. Configured groups list theirs, e.g. a group
+// for volunteers who may mark orders as paid but not delete members.
+var Permissions = map[string]string{
+	"products.edit":    "Create, change and delete products, variants and categories",
+	"orders.view":      "See all orders and their invoices",
+	"orders.mark-paid": "Mark new orders as paid",
+	"orders.edit":      "Change the status of orders",
+	"orders.delete":    "Delete orders",
+	"members.view":     "See all members",
+	"members.manage":   "Change and delete members, reset their passwords and log them out",
+	"coupons.manage":   "Create and delete discount codes",
+	"bank.import":      "Import bank statements and assign payments",
+	"tokens.manage":    "See and revoke the API tokens of all members",
+}
+
+func CheckPermissions(perms []string) error {
+	for _, p := range perms {
+		if _, ok := Permissions[p]; !ok {
+			return errors.New("Unknown permission '" + p + "'")
+		}
+	}
+	return nil
+}
+
+// Permissions of the members of the group, sorted by name.
+func GroupPermissions(group string) []string {
+	perms := make([]string, 0)
+
+	switch group {
+	case "admin":
+		for p := range Permissions {
+			perms = append(perms, p)
+		}
+	default:
+		for _, g := range GlobalConfig.Groups {
+			if g.Id == group {
+				perms = append(perms, g.Permissions...)
+			}
+		}
+	}
+
+	sort.Strings(perms)
+	return perms
+}
+
+func HasPermission(mem Member, perm string) bool {
+	if mem.Id == 0 {
+		return false
+	}
+
+	for _, p := range GroupPermissions(mem.Group) {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails with 401 for guests and 403 for members without the permission.
+func RequirePermission(mem Member, perm string) error {
+	if mem.Id == 0 {
+		return NewStatusError(401, "Please login first")
+	}
+	if !HasPermission(mem, perm) {
+		return NewStatusError(403, "Insufficient permissions")
+	}
+	return nil
+}
+
+// Whether the member has every permission of the group. Members may only put
+// others into, or manage members of, groups that can't do more than they can.
+func CanManageGroup(mem Member, group string) bool {
+	for _, p := range GroupPermissions(group) {
+		if !HasPermission(mem, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Marking orders as paid needs "orders.mark-paid", every other status change
+// "orders.edit".
+func CanSetOrderStatus(mem Member, status string) bool {
+	if status == "paid" && HasPermission(mem, "orders.mark-paid") {
+		return true
+	}
+	return HasPermission(mem, "orders.edit")
+}
@@ -11,13 +11,62 @@ import (
 )
 
 type Product struct {
-	Id          int64
-	Name        string
-	Slug        string
-	Description string
-	Price       uint64
-	Count       uint64
-	//	Images      []string
+	Id          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Slug        string            `json:"slug"`
+	Description string            `json:"description"`
+	Price       uint64            `json:"price"`
+	GroupPrices map[string]uint64 `json:"groupPrices"` // Prices for member groups that don't pay Price
+	Count       uint64            `json:"count"`       // In stock, including items reserved in carts
+	Reserved    uint64            `json:"reserved"`    // Reserved by active carts
+	Category    int64             `json:"category"`    // 0 if not in any category
+	TaxClass    string            `json:"taxClass"`    // Empty for the default class
+	Weight      uint64            `json:"weight"`      // In grams, used for shipping costs
+	Images      []string          `json:"images"`      // File names in the image directory
+	Variants    []Variant         `json:"variants"`    // Empty if the product comes in one version only
+}
+
+// Number of items that can still be put into a cart.
+func (prod Product) Available() uint64 {
+	if len(prod.Variants) > 0 {
+		var avail uint64
+		for _, v := range prod.Variants {
+			avail += v.Available()
+		}
+		return avail
+	}
+
+	if prod.Reserved > prod.Count {
+		return 0
+	}
+	return prod.Count - prod.Reserved
+}
+
+// Fills the fields of prod that are not stored in the products table.
+func FetchProductDetails(prod Product, database *sql.DB) (Product, error) {
+	var err error
+
+	prod.Images, err = FetchProductImages(prod.Id, database)
+	if err != nil {
+		return Product{}, err
+	}
+
+	prod.Reserved, err = ReservedCount(prod.Id, 0, database)
+	if err != nil {
+		return Product{}, err
+	}
+
+	prod.Variants, err = FetchVariants(prod.Id, database)
+	if err != nil {
+		return Product{}, err
+	}
+
+	prod.GroupPrices, err = FetchGroupPrices(prod.Id, database)
+	if err != nil {
+		return Product{}, err
+	}
+
+	return prod, nil
 }
 
 func FetchProduct(id int64, database *sql.DB) (Product, error) {
@@ -34,11 +83,15 @@ func FetchProduct(id int64, database *sql.DB) (Product, error) {
 	prod, err := ProductFromRow(rows)
 	rows.Close()
 
-	return prod, err
+	if err != nil {
+		return Product{}, err
+	}
+
+	return FetchProductDetails(prod, database)
 }
 
 func InsertProduct(prod Product, database *sql.DB) (Product, error) {
-	res, err := database.Exec("INSERT INTO products VALUES ( NULL, ?, ?, ?, ?, ? )", prod.Name, prod.Slug, prod.Description, prod.Price, prod.Count)
+	res, err := database.Exec("INSERT INTO products VALUES ( NULL, ?, ?, ?, ?, ?, ?, ?, ? )", prod.Name, prod.Slug, prod.Description, prod.Price, prod.Count, prod.Category, prod.TaxClass, prod.Weight)
 
 	if err != nil {
 		return Product{}, err
@@ -50,14 +103,14 @@ func InsertProduct(prod Product, database *sql.DB) (Product, error) {
 			return Product{}, err
 		} else {
 			prod.Id = id
-			return prod, nil
+			return prod, SaveGroupPrices(prod, database)
 		}
 	}
 }
 
 func UpdateProduct(prod Product, database *sql.DB) (Product, error) {
-	res, err := database.Exec("UPDATE products SET name = ?, slug = ?, description = ?, price = ?, count = ? WHERE id = ?",
-		prod.Name, prod.Slug, prod.Description, prod.Price, prod.Count, prod.Id)
+	res, err := database.Exec("UPDATE products SET name = ?, slug = ?, description = ?, price = ?, count = ?, category = ?, taxclass = ?, weight = ? WHERE id = ?",
+		prod.Name, prod.Slug, prod.Description, prod.Price, prod.Count, prod.Category, prod.TaxClass, prod.Weight, prod.Id)
 
 	if err != nil {
 		return Product{}, err
@@ -76,25 +129,94 @@ func UpdateProduct(prod Product, database *sql.DB) (Product, error) {
 			return Product{}, fmt.Errorf("Product in database more than once")
 		}
 
-		return prod, nil
+		return prod, SaveGroupPrices(prod, database)
+	}
+}
+
+// Checks that the required fields are set, the name is unique and the
+// category, tax class and member groups exist.
+func CheckProduct(prod Product, database *sql.DB) error {
+	if prod.Name == "" || prod.Slug == "" || prod.Description == "" {
+		return NewStatusError(400, "Missing name, slug or description")
+	}
+
+	rows, err := database.Query("SELECT * FROM products WHERE name = ? AND id <> ?", prod.Name, prod.Id)
+	if err != nil {
+		return err
+	}
+
+	exists := rows.Next()
+	rows.Close()
+
+	if exists {
+		return NewStatusError(400, "exists already")
+	}
+
+	if prod.Category != 0 {
+		_, err = FetchCategory(prod.Category, database)
+		if err != nil {
+			return NewStatusError(400, "%s", err.Error())
+		}
+	}
+
+	err = CheckTaxClass(prod.TaxClass)
+	if err != nil {
+		return err
+	}
+
+	return CheckGroupPrices(prod.GroupPrices)
+}
+
+// Deletes the product and its images.
+func RemoveProduct(prod Product, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM products WHERE id = ?", prod.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM variant_prices WHERE variant IN (SELECT id FROM variants WHERE product = ?)", prod.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM variants WHERE product = ?", prod.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM product_prices WHERE product = ?", prod.Id)
+	if err != nil {
+		return err
 	}
+
+	return DeleteProductImages(prod.Id, database)
 }
 
 func ProductFromRow(rows *sql.Rows) (Product, error) {
-	var name, slug, desc string
-	var id int64
-	var price, count uint64
+	var name, slug, desc, class string
+	var id, cat int64
+	var price, count, weight uint64
 
-	err := rows.Scan(&id, &name, &slug, &desc, &price, &count)
+	err := rows.Scan(&id, &name, &slug, &desc, &price, &count, &cat, &class, &weight)
 	if err != nil {
 		return Product{}, err
 	}
-	return Product{id, name, slug, desc, price, count}, nil
+	return Product{
+		Id:          id,
+		Name:        name,
+		Slug:        slug,
+		Description: desc,
+		Price:       price,
+		Count:       count,
+		Category:    cat,
+		TaxClass:    class,
+		Weight:      weight,
+	}, nil
 }
 
 func ProductFromForm(form url.Values) (Product, error) {
 	var ok bool
-	var names, slugs, descs, prices, counts []string
+	var names, slugs, descs, prices, counts, cats []string
 	var ret Product
 
 	// Name
@@ -140,6 +262,31 @@ func ProductFromForm(form url.Values) (Product, error) {
 		return ret, fmt.Errorf("Invalid count")
 	}
 
+	// Category
+	var cat int64
+	cats, ok = form["category"]
+	if ok && len(cats) == 1 && len(cats[0]) > 0 {
+		cat, err = strconv.ParseInt(cats[0], 10, 64)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid category")
+		}
+	}
+
+	// Weight
+	var weight uint64
+	weights, ok := form["weight"]
+	if ok && len(weights) == 1 && len(weights[0]) > 0 {
+		weight, err = strconv.ParseUint(weights[0], 10, 64)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid weight")
+		}
+	}
+
+	groupPrices, err := GroupPricesFromForm(form)
+	if err != nil {
+		return ret, err
+	}
+
 	ret = Product{
 		Id:          0,
 		Name:        name,
@@ -147,6 +294,10 @@ func ProductFromForm(form url.Values) (Product, error) {
 		Description: desc,
 		Price:       price,
 		Count:       count,
+		Category:    cat,
+		TaxClass:    form.Get("taxclass"),
+		Weight:      weight,
+		GroupPrices: groupPrices,
 	}
 
 	return ret, nil
@@ -170,39 +321,71 @@ func GetProducts(mem Member, w http.ResponseWriter, r *http.Request) {
 			prods = append(prods, prod)
 		}
 	}
+	rows.Close()
+
+	for i := range prods {
+		prods[i], err = FetchProductDetails(prods[i], Database)
+
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
 
+	cats, err := FetchCategories(Database)
 	DatabaseMutex.Unlock()
 
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	meta := struct {
-		Products []Product
-		Member   Member
+		Products   []Product
+		Category   Category
+		Categories []Category
+		Member     Member
 	}{
 		prods,
+		Category{},
+		cats,
 		mem,
 	}
 
-	RenderTemplate(w, "products/list", "", mem, meta)
+	RenderTemplate(w, r, "products/list", "", mem, meta)
 }
 
 func GetProduct(prod Product, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	cats, err := FetchCategories(Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	meta := struct {
-		Product Product
-		Member  Member
+		Product    Product
+		Categories []Category
+		Member     Member
 	}{
 		prod,
+		cats,
 		mem,
 	}
 
-	RenderTemplate(w, "products/single", "", mem, meta)
+	RenderTemplate(w, r, "products/single", "", mem, meta)
 }
 
 func PutProduct(prod Product, mem Member, w http.ResponseWriter, r *http.Request) {
-	if mem.Group != "admin" {
+	if !HasPermission(mem, "products.edit") {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
 
-	err := r.ParseForm()
+	err := ParseAnyForm(r)
 	if err != nil {
 		http.Error(w, "Failed to update product: "+err.Error(), 500)
 		return
@@ -215,59 +398,69 @@ func PutProduct(prod Product, mem Member, w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	new_prod.Id = prod.Id
+
 	DatabaseMutex.Lock()
-	var rows *sql.Rows
-	rows, err = Database.Query("SELECT * FROM products WHERE name = ? AND id <> ?", new_prod.Name, prod.Id)
+	err = CheckProduct(new_prod, Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		http.Error(w, "Failed to update product: "+err.Error(), 500)
-		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to update product: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	exists := rows.Next()
-	rows.Close()
-	DatabaseMutex.Unlock()
-
-	if exists {
-		http.Error(w, "Failed to update product: exists already", 400)
+	// Decoding large images takes a while, don't block the shop meanwhile
+	imgs, err := StoreUploadedImages(r)
+	if err != nil {
+		http.Error(w, "Failed to save image: "+err.Error(), 400)
 		return
 	}
 
 	DatabaseMutex.Lock()
-	new_prod.Id = prod.Id
 	prod, err = UpdateProduct(new_prod, Database)
-	DatabaseMutex.Unlock()
 
 	if err != nil {
+		DatabaseMutex.Unlock()
+		DiscardImages(imgs)
 		http.Error(w, "Failed to parse product form: "+err.Error(), 500)
 		return
 	}
 
+	for _, name := range r.PostForm["remove_images"] {
+		err = DeleteProductImage(prod.Id, name, Database)
+
+		if err != nil {
+			DatabaseMutex.Unlock()
+			DiscardImages(imgs)
+			http.Error(w, "Failed to remove image: "+err.Error(), 400)
+			return
+		}
+	}
+
+	err = AddProductImages(prod.Id, imgs, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		DiscardImages(imgs)
+		http.Error(w, "Failed to save image: "+err.Error(), 500)
+		return
+	}
+
 	http.Redirect(w, r, "/products/"+strconv.FormatInt(prod.Id, 10), 301)
 }
 
 func DeleteProduct(prod Product, mem Member, w http.ResponseWriter, r *http.Request) {
-	if mem.Group != "admin" {
+	if !HasPermission(mem, "products.edit") {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
 
 	DatabaseMutex.Lock()
-	rows, err := Database.Query("DELETE FROM products WHERE id = ?", prod.Id)
+	err := RemoveProduct(prod, Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
 		http.Error(w, "Failed delete product: "+err.Error(), 500)
-		DatabaseMutex.Unlock()
-		return
-	}
-
-	exists := rows.Next()
-	rows.Close()
-	DatabaseMutex.Unlock()
-
-	if exists {
-		http.Error(w, "Failed delete product: does not exists", 400)
 		return
 	}
 
@@ -275,12 +468,12 @@ func DeleteProduct(prod Product, mem Member, w http.ResponseWriter, r *http.Requ
 }
 
 func PostNewProduct(mem Member, w http.ResponseWriter, r *http.Request) {
-	if mem.Group != "admin" {
+	if !HasPermission(mem, "products.edit") {
 		http.Error(w, "Insufficient permissions", 403)
 		return
 	}
 
-	err := r.ParseForm()
+	err := ParseAnyForm(r)
 	if err != nil {
 		http.Error(w, "Failed to update product: "+err.Error(), 500)
 		return
@@ -294,33 +487,40 @@ func PostNewProduct(mem Member, w http.ResponseWriter, r *http.Request) {
 	}
 
 	DatabaseMutex.Lock()
-	var rows *sql.Rows
-	rows, err = Database.Query("SELECT * FROM products WHERE name = ?", prod.Name)
+	err = CheckProduct(prod, Database)
+	DatabaseMutex.Unlock()
 
 	if err != nil {
-		http.Error(w, "Failed create product: "+err.Error(), 500)
-		DatabaseMutex.Unlock()
+		http.Error(w, "Failed create product: "+err.Error(), ErrorStatus(err))
 		return
 	}
 
-	exists := rows.Next()
-	rows.Close()
-	DatabaseMutex.Unlock()
-
-	if exists {
-		http.Error(w, "Failed create product: exists already", 400)
+	// Decoding large images takes a while, don't block the shop meanwhile
+	imgs, err := StoreUploadedImages(r)
+	if err != nil {
+		http.Error(w, "Failed to save image: "+err.Error(), 400)
 		return
 	}
 
 	DatabaseMutex.Lock()
 	prod, err = InsertProduct(prod, Database)
-	DatabaseMutex.Unlock()
 
 	if err != nil {
+		DatabaseMutex.Unlock()
+		DiscardImages(imgs)
 		http.Error(w, "Failed to parse product form: "+err.Error(), 500)
 		return
 	}
 
+	err = AddProductImages(prod.Id, imgs, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		DiscardImages(imgs)
+		http.Error(w, "Failed to save image: "+err.Error(), 500)
+		return
+	}
+
 	http.Redirect(w, r, "/products/"+strconv.FormatInt(prod.Id, 10), 301)
 }
 
@@ -364,7 +564,7 @@ func HandleProduct(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			GetProduct(prod, mem, w, r)
 		} else if r.Method == "POST" {
-			err := r.ParseForm()
+			err := ParseAnyForm(r)
 
 			if err != nil {
 				http.Error(w, "Failed to parse form data: "+err.Error(), 500)
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Password reset tokens are valid for one hour
+const PasswordResetLifetime int64 = 60 * 60
+
+type PasswordReset struct {
+	Member  Member
+	Token   string
+	Expires int64 // Unix time
+}
+
+func NewPasswordReset(mem Member, database *sql.DB) (PasswordReset, error) {
+	tok := make([]byte, 32)
+	_, err := rand.Read(tok)
+
+	if err != nil {
+		return PasswordReset{}, err
+	}
+
+	reset := PasswordReset{mem, hex.EncodeToString(tok), time.Now().Unix() + PasswordResetLifetime}
+	_, err = database.Exec("INSERT INTO password_resets VALUES ( ?, ?, ?, 0 )", HashToken(reset.Token), mem.Id, reset.Expires)
+
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+// Returns the member the token was issued for if it is neither used nor
+// expired.
+func CheckPasswordReset(token string, database *sql.DB) (int64, error) {
+	rows, err := database.Query("SELECT member FROM password_resets WHERE token = ? AND used = 0 AND expires >= ?", HashToken(token), time.Now().Unix())
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return 0, errors.New("Invalid or expired token")
+	}
+
+	var memId int64
+	err = rows.Scan(&memId)
+	rows.Close()
+
+	return memId, err
+}
+
+// Sets the new password of the member the token belongs to and invalidates
+// the token as well as all other tokens of the member.
+func UsePasswordReset(token string, passwd string, database *sql.DB) (int64, error) {
+	memId, err := CheckPasswordReset(token, database)
+	if err != nil {
+		return 0, err
+	}
+
+	hash, err := HashPassword(passwd)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("UPDATE password_resets SET used = 1 WHERE token = ? AND used = 0", HashToken(token))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	cnt, err := res.RowsAffected()
+	if err != nil || cnt != 1 {
+		tx.Rollback()
+		return 0, errors.New("Invalid or expired token")
+	}
+
+	_, err = tx.Exec("UPDATE password_resets SET used = 1 WHERE member = ?", memId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE members SET passwd = ? WHERE id = ?", hash, memId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return memId, tx.Commit()
+}
+
+// Removes tokens that can no longer be used.
+func DeleteExpiredPasswordResets(database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM password_resets WHERE used <> 0 OR expires < ?", time.Now().Unix())
+	return err
+}
+
+// Mails a reset link to every member whose name or email address matches. The
+// response does not tell whether a member was found.
+func PostForgotPasswd(cur_mem Member, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed parse <form>: "+err.Error(), 500)
+		return
+	}
+
+	names, ok := r.PostForm["name"]
+	if !ok || len(names) != 1 || names[0] == "" {
+		http.Error(w, "No name or email given", 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+
+	err = DeleteExpiredPasswordResets(Database)
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to reset password: "+err.Error(), 500)
+		return
+	}
+
+	rows, err := Database.Query("SELECT * FROM members WHERE id <> 0 AND (name = ? OR email = ?)", names[0], names[0])
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to reset password: "+err.Error(), 500)
+		return
+	}
+
+	mems := make([]Member, 0)
+	for rows.Next() {
+		mems = append(mems, MemberFromRow(rows))
+	}
+	rows.Close()
+
+	resets := make([]PasswordReset, 0)
+	for _, mem := range mems {
+		reset, err := NewPasswordReset(mem, Database)
+		if err != nil {
+			DatabaseMutex.Unlock()
+			http.Error(w, "Failed to reset password: "+err.Error(), 500)
+			return
+		}
+		resets = append(resets, reset)
+	}
+
+	DatabaseMutex.Unlock()
+
+	for _, reset := range resets {
+		SendMail(reset.Member.EMail, "mails/reset", reset)
+	}
+
+	RenderTemplate(w, r, "members/forgot", "", cur_mem, true)
+}
+
+func GetResetPasswd(cur_mem Member, w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	DatabaseMutex.Lock()
+	_, err := CheckPasswordReset(token, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to reset password: "+err.Error(), 400)
+		return
+	}
+
+	RenderTemplate(w, r, "members/reset", "", cur_mem, map[string]interface{}{
+		"Token": token,
+		"Done":  false,
+	})
+}
+
+func PostResetPasswd(cur_mem Member, w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed parse <form>: "+err.Error(), 500)
+		return
+	}
+
+	tokens, ok := r.PostForm["token"]
+	if !ok || len(tokens) != 1 || tokens[0] == "" {
+		http.Error(w, "Failed to reset password: no token given", 400)
+		return
+	}
+
+	passwds, ok := r.PostForm["passwd"]
+	if !ok || len(passwds) != 1 || len(passwds[0]) < MinPasswordLength {
+		http.Error(w, fmt.Sprintf("Failed to reset password: passwords must be %d characters or longer", MinPasswordLength), 400)
+		return
+	}
+
+	if r.PostForm.Get("passwd2") != passwds[0] {
+		http.Error(w, "Failed to reset password: passwords do not match", 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+
+	memId, err := UsePasswordReset(tokens[0], passwds[0], Database)
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to reset password: "+err.Error(), 400)
+		return
+	}
+
+	err = DeleteMemberSessions(memId, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to log out sessions: "+err.Error(), 500)
+		return
+	}
+
+	// The session of the current request is gone as well
+	if cur_mem.Id == memId {
+		cur_mem = Member{}
+	}
+
+	RenderTemplate(w, r, "members/reset", "", cur_mem, map[string]interface{}{
+		"Token": "",
+		"Done":  true,
+	})
+}
+
+func HandleForgotPasswd(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	if r.Method == "POST" {
+		PostForgotPasswd(mem, w, r)
+	} else if r.Method == "GET" {
+		RenderTemplate(w, r, "members/forgot", "", mem, false)
+	} else {
+		http.Error(w, "Method not supported", 405)
+	}
+}
+
+func HandleResetPasswd(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	if r.Method == "POST" {
+		PostResetPasswd(mem, w, r)
+	} else if r.Method == "GET" {
+		GetResetPasswd(mem, w, r)
+	} else {
+		http.Error(w, "Method not supported", 405)
+	}
+}
@@ -5,6 +5,28 @@ import (
 	"net/http"
 )
 
+// Error that carries the HTTP status code it should be reported with.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e StatusError) Error() string {
+	return e.Message
+}
+
+func NewStatusError(code int, format string, args ...interface{}) error {
+	return StatusError{code, fmt.Sprintf(format, args...)}
+}
+
+// HTTP status code for err: the code of a StatusError, 500 otherwise.
+func ErrorStatus(err error) int {
+	if se, ok := err.(StatusError); ok {
+		return se.Code
+	}
+	return 500
+}
+
 func notImplHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Not Implemented yet :(")
 }
@@ -13,6 +35,17 @@ func staticFileHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, r.URL.Path[1:])
 }
 
+// Same as r.ParseForm() but also parses multipart/form-data bodies, e.g. file
+// uploads.
+func ParseAnyForm(r *http.Request) error {
+	err := r.ParseMultipartForm(MaxUploadSize)
+
+	if err == http.ErrNotMultipart {
+		return nil
+	}
+	return err
+}
+
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/" {
 		sess := FetchOrCreateSession(w, r, Database)
@@ -21,7 +54,7 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			http.Error(w, "Failed to fetch member: "+err.Error(), 500)
 		} else {
-			RenderTemplate(w, "index", "", mem, "")
+			RenderTemplate(w, r, "index", "", mem, "")
 		}
 	} else {
 		http.Error(w, "Not found", 404)
@@ -37,28 +70,42 @@ func pagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RenderTemplate(w, r.URL.Path[1:], "", mem, "")
+	RenderTemplate(w, r, r.URL.Path[1:], "", mem, "")
 }
 
 func InitializeRoutes() error {
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/pages/", pagesHandler)
 
-	http.HandleFunc("/categories/", notImplHandler)
+	http.HandleFunc("/categories/", HandleCategory)
 	http.HandleFunc("/products/", HandleProduct)
+	http.HandleFunc("/variants/", HandleVariant)
 
 	http.HandleFunc("/orders/", HandleOrder)
 	http.HandleFunc("/orders/new", HandleOrdersNew)
 	http.HandleFunc("/orders/my", GetMyOrders)
+	http.HandleFunc("/orders/qr/", HandlePaymentQRCode)
+	http.HandleFunc("/orders/invoice/", HandleInvoice)
+	http.HandleFunc("/orders/lookup/", HandleOrderLookup)
+	http.HandleFunc("/bank/", HandleBank)
+	http.HandleFunc("/coupons/", HandleCoupon)
 
 	http.HandleFunc("/cart/", HandleCart)
 
 	http.HandleFunc("/members/", HandleMember)
 	http.HandleFunc("/members/login", HandleLogin)
+	http.HandleFunc("/members/logout", HandleLogout)
+	http.HandleFunc("/members/forgot", HandleForgotPasswd)
+	http.HandleFunc("/members/reset", HandleResetPasswd)
+
+	http.HandleFunc("/sessions/", HandleSession)
+	http.HandleFunc("/tokens/", HandleAPIToken)
+	http.HandleFunc("/addresses/", HandleAddress)
 
-	http.HandleFunc("/sessions/", notImplHandler)
+	http.HandleFunc(APIPrefix, HandleAPI)
 
 	http.HandleFunc("/static/", staticFileHandler)
+	http.HandleFunc("/images/", HandleImage)
 
 	return nil
 }
@@ -7,37 +7,73 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Sessions and the cart reservations attached to them expire after 3 days
+const SessionLifetime int64 = 3 * 60 * 60 * 24
+
+// Longest user agent string stored with a session
+const MaxUserAgentLength int = 256
+
 type Session struct {
-	Id       string
-	Member   int64
-	LastSeen int64 // Unix time
+	Num       int64 // Row id, refers to the session without revealing its id
+	Id        string
+	Member    int64
+	LastSeen  int64 // Unix time
+	UserAgent string
+	IP        string
+	Created   int64  // Unix time
+	CSRF      string // Token that must accompany every form post
 }
 
+// Expects the columns of "SELECT rowid, * FROM sessions".
 func SessionFromRow(rows *sql.Rows) Session {
-	var id string
-	var mem, time int64
+	var id, agent, ip, csrf string
+	var num, mem, time, created int64
 
-	err := rows.Scan(&id, &mem, &time)
+	err := rows.Scan(&num, &id, &mem, &time, &agent, &ip, &created, &csrf)
 	if err != nil {
 		panic(err.Error())
 	}
-	return Session{id, mem, time}
+	return Session{num, id, mem, time, agent, ip, created, csrf}
+}
+
+func ClientUserAgent(r *http.Request) string {
+	agent := r.UserAgent()
+	if len(agent) > MaxUserAgentLength {
+		agent = agent[:MaxUserAgentLength]
+	}
+	return agent
+}
+
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func NewSession(database *sql.DB) (Session, error) {
-	id := make([]byte, 32)
+func NewSession(r *http.Request, database *sql.DB) (Session, error) {
+	id := make([]byte, 64)
 	_, err := rand.Read(id)
 
 	if err != nil {
 		return Session{}, err
 	}
 
-	sess := Session{hex.EncodeToString(id), 0, time.Now().Unix()}
-	_, err = database.Exec("INSERT INTO sessions VALUES ( ?, ?, ? )", sess.Id, sess.Member, sess.LastSeen)
+	now := time.Now().Unix()
+	sess := Session{0, hex.EncodeToString(id[:32]), 0, now, ClientUserAgent(r), ClientIP(r), now, hex.EncodeToString(id[32:])}
+	res, err := database.Exec("INSERT INTO sessions VALUES ( ?, ?, ?, ?, ?, ?, ? )", sess.Id, sess.Member, sess.LastSeen, sess.UserAgent, sess.IP, sess.Created, sess.CSRF)
+
+	if err == nil {
+		sess.Num, err = res.LastInsertId()
+	}
 
 	if err != nil {
 		return Session{}, err
@@ -58,34 +94,61 @@ func LoginSession(sess string, mem int64, database *sql.DB) error {
 		} else if cnt != 1 {
 			return errors.New("Invalid affected row count: " + fmt.Sprintf("%d", cnt))
 		} else {
-			return nil
+			return MergeCart(sess, mem, database)
 		}
 	}
 }
 
-func RefreshSession(id string, database *sql.DB) (Session, error) {
-	rows, err := database.Query("SELECT * FROM sessions WHERE id = ?", id)
+func RefreshSession(id string, r *http.Request, database *sql.DB) (Session, error) {
+	rows, err := database.Query("SELECT rowid, * FROM sessions WHERE id = ?", id)
 
 	if err != nil {
 		return Session{}, err
 	}
 
 	if !rows.Next() {
+		rows.Close()
 		return Session{}, errors.New("No such session")
 	}
 
 	sess := SessionFromRow(rows)
 	rows.Close()
 
-	if time.Now().Unix()-sess.LastSeen > 3*60*60*24 {
-		return NewSession(database)
+	if time.Now().Unix()-sess.LastSeen > SessionLifetime {
+		return NewSession(r, database)
 	} else {
-		_, err = database.Exec("UPDATE sessions SET lastseen = ? WHERE id = ?", time.Now().Unix(), sess.Id)
+		sess.LastSeen = time.Now().Unix()
+		sess.UserAgent = ClientUserAgent(r)
+		sess.IP = ClientIP(r)
 
+		_, err = database.Exec("UPDATE sessions SET lastseen = ?, useragent = ?, ip = ? WHERE id = ?", sess.LastSeen, sess.UserAgent, sess.IP, sess.Id)
+		if err != nil {
+			return sess, err
+		}
+
+		sessId, memId := CartOwner(sess)
+		_, err = database.Exec("UPDATE carts SET reserved = ? WHERE session = ? AND member = ?", time.Now().Unix(), sessId, memId)
 		return sess, err
 	}
 }
 
+// Logs out the session and drops its cart. Carts of members stay with them.
+func DeleteSession(id string, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM carts WHERE session = ? AND member = 0", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// Logs out all sessions of the member. The cart of the member is kept.
+func DeleteMemberSessions(mem int64, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM sessions WHERE member = ?", mem)
+	return err
+}
+
 func NewCookie(name string, value string, exp time.Time) http.Cookie {
 	return http.Cookie{
 		Name:    name,
@@ -97,7 +160,13 @@ func NewCookie(name string, value string, exp time.Time) http.Cookie {
 	}
 }
 
+// Returns the session of the request. The session is fetched once per request
+// by SessionHandler, later calls return the same session.
 func FetchOrCreateSession(w http.ResponseWriter, r *http.Request, database *sql.DB) Session {
+	if sess, ok := RequestSession(r); ok {
+		return sess
+	}
+
 	c, err := r.Cookie("sessid")
 	var sess Session
 
@@ -106,16 +175,16 @@ func FetchOrCreateSession(w http.ResponseWriter, r *http.Request, database *sql.
 			log.Panicln(err)
 		}
 
-		sess, err = NewSession(database)
+		sess, err = NewSession(r, database)
 
 		if err != nil {
 			panic(err.Error())
 		}
 	} else if err == nil {
-		sess, err = RefreshSession(c.Value, database)
+		sess, err = RefreshSession(c.Value, r, database)
 
 		if err != nil {
-			sess, err = NewSession(database)
+			sess, err = NewSession(r, database)
 
 			if err != nil {
 				log.Panicln(err.Error())
@@ -127,3 +196,152 @@ func FetchOrCreateSession(w http.ResponseWriter, r *http.Request, database *sql.
 	http.SetCookie(w, &coo)
 	return sess
 }
+
+// Active sessions of the member, most recently used first.
+func FetchMemberSessions(mem int64, database *sql.DB) ([]Session, error) {
+	rows, err := database.Query("SELECT rowid, * FROM sessions WHERE member = ? AND lastseen >= ? ORDER BY lastseen DESC", mem, time.Now().Unix()-SessionLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		sessions = append(sessions, SessionFromRow(rows))
+	}
+	rows.Close()
+
+	return sessions, nil
+}
+
+func GetSessions(owner Member, member Member, session Session, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sessions, err := FetchMemberSessions(owner.Id, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions: "+err.Error(), 500)
+		return
+	}
+
+	meta := struct {
+		Owner    Member
+		Sessions []Session
+		Current  Session
+		Member   Member
+	}{
+		owner,
+		sessions,
+		session,
+		member,
+	}
+
+	RenderTemplate(w, r, "sessions/list", "", member, meta)
+}
+
+// Revokes a single session of the member other than the current one.
+func DeleteSessionNum(num int64, member Member, session Session, w http.ResponseWriter, r *http.Request) {
+	if num == session.Num {
+		http.Error(w, "Failed to revoke session: use logout to end the current session", 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	rows, err := Database.Query("SELECT rowid, * FROM sessions WHERE rowid = ? AND member = ?", num, member.Id)
+
+	if err != nil {
+		DatabaseMutex.Unlock()
+		http.Error(w, "Failed to revoke session: "+err.Error(), 500)
+		return
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		DatabaseMutex.Unlock()
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	sess := SessionFromRow(rows)
+	rows.Close()
+
+	err = DeleteSession(sess.Id, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to revoke session: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/sessions/", 301)
+}
+
+// Revokes all sessions of the member except the current one.
+func DeleteOtherSessions(member Member, session Session, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	_, err := Database.Exec("DELETE FROM sessions WHERE member = ? AND id <> ?", member.Id, session.Id)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/sessions/", 301)
+}
+
+func HandleSession(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleSession() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if mem.Id == 0 {
+		http.Redirect(w, r, "/pages/login", 301)
+		return
+	}
+
+	meth := r.Method
+	if r.Method == "POST" {
+		err := r.ParseForm()
+
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		meths, ok := r.PostForm["_method"]
+		if ok && len(meths) == 1 && len(meths[0]) > 0 {
+			meth = meths[0]
+		}
+	}
+
+	if r.URL.Path == "/sessions" || r.URL.Path == "/sessions/" {
+		if meth == "GET" {
+			GetSessions(mem, mem, sess, w, r)
+		} else if meth == "DELETE" {
+			DeleteOtherSessions(mem, sess, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		num, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+
+		if err != nil {
+			http.Error(w, "Session not found: "+err.Error(), 404)
+			return
+		}
+
+		if meth == "DELETE" {
+			DeleteSessionNum(num, mem, sess, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Price of shipping orders up to the given weight and number of items
+type ShippingRule struct {
+	MaxWeight uint64 // In grams, 0 for no limit
+	MaxItems  uint64 // 0 for no limit
+	Price     uint64
+}
+
+// A way of getting the items to the customer, e.g. pickup or parcel. The
+// first rule that fits the order determines the price. Methods without rules
+// are free, methods without a fitting rule can't be used for the order.
+type ShippingMethod struct {
+	Id       string
+	Name     string
+	TaxClass string // Empty for the default class
+	Pickup   bool   // Collected by the customer, no shipping address needed
+	Rules    []ShippingRule
+}
+
+// Shipping as stored with the order
+type Shipping struct {
+	Method  string `json:"method"` // Empty for orders placed before shipping methods existed
+	Name    string `json:"name"`
+	Price   uint64 `json:"price"`
+	TaxRate uint64 `json:"taxRate"` // Hundredths of a percent
+}
+
+// Shipping method the customer can choose for the cart
+type ShippingOption struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Price uint64 `json:"price"`
+}
+
+func CheckShippingConfiguration(methods []ShippingMethod) error {
+	ids := make(map[string]bool)
+
+	for _, m := range methods {
+		if m.Id == "" || m.Name == "" {
+			return errors.New("Shipping methods need an id and a name")
+		}
+
+		if ids[m.Id] {
+			return errors.New("Duplicate shipping method '" + m.Id + "'")
+		}
+		ids[m.Id] = true
+
+		if m.TaxClass != "" {
+			if _, ok := GlobalConfig.Tax.Classes[m.TaxClass]; !ok {
+				return fmt.Errorf("Unknown tax class '%s' of shipping method '%s'", m.TaxClass, m.Id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Total weight and number of items in the cart.
+func CartWeight(cart []CartItem) (uint64, uint64) {
+	var weight, items uint64
+
+	for _, itm := range cart {
+		weight += itm.Product.Weight * itm.Amount
+		items += itm.Amount
+	}
+
+	return weight, items
+}
+
+// Price of shipping the cart. Returns false if the method can't be used.
+func (m ShippingMethod) PriceFor(cart []CartItem) (uint64, bool) {
+	if len(m.Rules) == 0 {
+		return 0, true
+	}
+
+	weight, items := CartWeight(cart)
+	for _, rule := range m.Rules {
+		if (rule.MaxWeight == 0 || weight <= rule.MaxWeight) && (rule.MaxItems == 0 || items <= rule.MaxItems) {
+			return rule.Price, true
+		}
+	}
+
+	return 0, false
+}
+
+// All shipping methods that can be used for the cart, in configuration order.
+func ShippingOptions(cart []CartItem) []ShippingOption {
+	opts := make([]ShippingOption, 0)
+
+	for _, m := range GlobalConfig.Shipping {
+		if price, ok := m.PriceFor(cart); ok {
+			opts = append(opts, ShippingOption{m.Id, m.Name, price})
+		}
+	}
+
+	return opts
+}
+
+// Whether orders shipped with the method need a shipping address.
+func ShippingNeedsAddress(id string) bool {
+	for _, m := range GlobalConfig.Shipping {
+		if m.Id == id {
+			return !m.Pickup
+		}
+	}
+
+	return false
+}
+
+// Shipping of the cart with the method of the given id. An empty id selects
+// the first method that can be used. Without configured methods shipping is
+// free.
+func SelectShipping(id string, cart []CartItem) (Shipping, error) {
+	if len(GlobalConfig.Shipping) == 0 && id == "" {
+		return Shipping{}, nil
+	}
+
+	for _, m := range GlobalConfig.Shipping {
+		if id != "" && m.Id != id {
+			continue
+		}
+
+		price, ok := m.PriceFor(cart)
+		if ok {
+			return Shipping{m.Id, m.Name, price, TaxRate(m.TaxClass)}, nil
+		} else if id != "" {
+			return Shipping{}, NewStatusError(400, "%s is not available for this order", m.Name)
+		}
+	}
+
+	if id != "" {
+		return Shipping{}, NewStatusError(400, "Unknown shipping method '%s'", id)
+	}
+	return Shipping{}, NewStatusError(400, "No shipping method available for this order")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tax rates are stored in hundredths of a percent, i.e. 1900 is 19%.
+type TaxConfiguration struct {
+	NetPrices bool              // Product prices exclude tax, which is added on checkout
+	Classes   map[string]uint64 // Tax rate of each tax class, e.g. "standard": 1900
+	Default   string            // Class of products without one
+}
+
+// Tax of all items with the same rate
+type TaxLine struct {
+	Rate uint64 `json:"rate"` // Hundredths of a percent
+	Net  uint64 `json:"net"`
+	Tax  uint64 `json:"tax"`
+}
+
+type TaxClass struct {
+	Name string
+	Rate uint64
+}
+
+func CheckTaxConfiguration(cfg TaxConfiguration) error {
+	if len(cfg.Classes) == 0 {
+		if cfg.Default != "" {
+			return errors.New("Default tax class '" + cfg.Default + "' does not exist")
+		}
+		return nil
+	}
+
+	if _, ok := cfg.Classes[cfg.Default]; !ok {
+		return errors.New("Default tax class '" + cfg.Default + "' does not exist")
+	}
+
+	for name, rate := range cfg.Classes {
+		if rate > 10000 {
+			return fmt.Errorf("Tax rate of class '%s' is over 100%%", name)
+		}
+	}
+
+	return nil
+}
+
+func CheckTaxClass(class string) error {
+	if class == "" {
+		return nil
+	}
+
+	if _, ok := GlobalConfig.Tax.Classes[class]; !ok {
+		return NewStatusError(400, "Unknown tax class '%s'", class)
+	}
+
+	return nil
+}
+
+// Rate of the tax class. Products without a class or with one that was
+// removed from the configuration use the default class.
+func TaxRate(class string) uint64 {
+	if rate, ok := GlobalConfig.Tax.Classes[class]; ok {
+		return rate
+	}
+	return GlobalConfig.Tax.Classes[GlobalConfig.Tax.Default]
+}
+
+// All configured tax classes ordered by name.
+func TaxClasses() []TaxClass {
+	classes := make([]TaxClass, 0)
+	for name, rate := range GlobalConfig.Tax.Classes {
+		classes = append(classes, TaxClass{name, rate})
+	}
+
+	sort.Slice(classes, func(i, j int) bool { return classes[i].Name < classes[j].Name })
+	return classes
+}
+
+// Formats a rate as percentage without trailing zeros, e.g. "19" or "7,5".
+func FormatTaxRate(rate uint64) string {
+	s := fmt.Sprintf("%d,%02d", rate/100, rate%100)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ",")
+}
+
+// Rounds num/div to the nearest integer.
+func divRound(num uint64, div uint64) uint64 {
+	return (num + div/2) / div
+}
+
+// Price of an item, shipping etc. and the tax rate that applies to it
+type TaxedAmount struct {
+	Amount uint64
+	Rate   uint64 // Hundredths of a percent
+}
+
+// Breaks the taxes of the amounts down by rate. With gross prices the tax is
+// contained in the amounts, with net prices it is added on top. Amounts
+// without tax get no tax line. Returns the taxes and the total to pay.
+func ComputeTaxes(amounts []TaxedAmount, netPrices bool) ([]TaxLine, uint64) {
+	var sum uint64
+	byRate := make(map[uint64]uint64)
+
+	for _, a := range amounts {
+		sum += a.Amount
+		byRate[a.Rate] += a.Amount
+	}
+
+	taxes := make([]TaxLine, 0)
+	for rate, amount := range byRate {
+		if rate == 0 {
+			continue
+		}
+
+		if netPrices {
+			tax := divRound(amount*rate, 10000)
+			taxes = append(taxes, TaxLine{rate, amount, tax})
+			sum += tax
+		} else {
+			tax := divRound(amount*rate, 10000+rate)
+			taxes = append(taxes, TaxLine{rate, amount - tax, tax})
+		}
+	}
+
+	sort.Slice(taxes, func(i, j int) bool { return taxes[i].Rate > taxes[j].Rate })
+	return taxes, sum
+}
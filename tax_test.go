@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputeTaxes(t *testing.T) {
+	tests := []struct {
+		name    string
+		amounts []TaxedAmount
+		net     bool
+		taxes   []TaxLine
+		total   uint64
+	}{
+		{"nothing", nil, false, []TaxLine{}, 0},
+		{"gross", []TaxedAmount{{1190, 1900}}, false, []TaxLine{{1900, 1000, 190}}, 1190},
+		{"net", []TaxedAmount{{1000, 1900}}, true, []TaxLine{{1900, 1000, 190}}, 1190},
+		// 999 * 19/119 = 159.50
+		{"gross, rounded up", []TaxedAmount{{999, 1900}}, false, []TaxLine{{1900, 839, 160}}, 999},
+		// 1003 * 19/119 = 160.14
+		{"gross, rounded down", []TaxedAmount{{1003, 1900}}, false, []TaxLine{{1900, 843, 160}}, 1003},
+		// 999 * 7% = 69.93
+		{"net, rounded up", []TaxedAmount{{999, 700}}, true, []TaxLine{{700, 999, 70}}, 1069},
+		// 50 * 7% = 3.5
+		{"net, half rounded up", []TaxedAmount{{50, 700}}, true, []TaxLine{{700, 50, 4}}, 54},
+		// 1001 * 7% = 70.07
+		{"net, rounded down", []TaxedAmount{{1001, 700}}, true, []TaxLine{{700, 1001, 70}}, 1071},
+		// 10 * 19/119 = 1.6 per item would add up to 6, 30 * 19/119 = 4.79
+		{"gross, rounded per rate", []TaxedAmount{{10, 1900}, {10, 1900}, {10, 1900}}, false, []TaxLine{{1900, 25, 5}}, 30},
+		// 5 * 7% = 0.35 per item would add up to 0, 15 * 7% = 1.05
+		{"net, rounded per rate", []TaxedAmount{{5, 700}, {5, 700}, {5, 700}}, true, []TaxLine{{700, 15, 1}}, 16},
+		{"gross, mixed rates", []TaxedAmount{{107, 700}, {500, 0}, {1190, 1900}}, false, []TaxLine{{1900, 1000, 190}, {700, 100, 7}}, 1797},
+		{"net, mixed rates", []TaxedAmount{{100, 700}, {500, 0}, {1000, 1900}}, true, []TaxLine{{1900, 1000, 190}, {700, 100, 7}}, 1797},
+		{"tax free", []TaxedAmount{{500, 0}, {250, 0}}, true, []TaxLine{}, 750},
+	}
+
+	for _, tt := range tests {
+		taxes, total := ComputeTaxes(tt.amounts, tt.net)
+		if !reflect.DeepEqual(taxes, tt.taxes) || total != tt.total {
+			t.Errorf("%s: got %v, %d, want %v, %d", tt.name, taxes, total, tt.taxes, tt.total)
+		}
+	}
+}
+
+func TestFormatTaxRate(t *testing.T) {
+	tests := []struct {
+		rate uint64
+		want string
+	}{
+		{0, "0"},
+		{700, "7"},
+		{1900, "19"},
+		{750, "7,5"},
+		{1025, "10,25"},
+		{10000, "100"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatTaxRate(tt.rate); got != tt.want {
+			t.Errorf("FormatTaxRate(%d) = %q, want %q", tt.rate, got, tt.want)
+		}
+	}
+}
@@ -9,27 +9,44 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	texttemplate "text/template"
 	"time"
 )
 
 var TemplateCache *template.Template
 
-func RenderTemplate(w http.ResponseWriter, tmpl string, title string, member Member, local interface{}) {
+// TemplateCache is never executed itself but cloned for every request, so
+// the clone can get request specific functions like csrfField.
+func RenderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, title string, member Member, local interface{}) {
 	fmt.Println("Render '" + tmpl + "' for " + member.Name)
 
-	master := TemplateCache.Lookup("master")
+	sess, _ := RequestSession(r)
+	templates, err := TemplateCache.Clone()
+	if err != nil {
+		http.Error(w, "Failed to clone templates: "+err.Error(), 500)
+		return
+	}
+
+	templates.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML { return CSRFFormField(sess) },
+	})
+
+	master := templates.Lookup("master")
 	global := struct {
 		Config Configuration
 		Member Member
+		CSRF   string
 	}{
 		Config: GlobalConfig,
 		Member: member,
+		CSRF:   sess.CSRF,
 	}
 
 	if master == nil {
 		http.Error(w, "Master template not found", 404)
 	} else {
-		page := TemplateCache.Lookup(tmpl)
+		page := templates.Lookup(tmpl)
 
 		if page == nil {
 			http.Error(w, "Template '"+tmpl+"' not found or invalid", 500)
@@ -65,13 +82,28 @@ func RenderTemplate(w http.ResponseWriter, tmpl string, title string, member Mem
 func InitializeTemplates() error {
 	funcs := template.FuncMap{
 		"isGuest":     IsGuest,
-		"isAdmin":     IsAdmin,
+		"can":         Can,
 		"formatDate":  FormatDate,
 		"formatMoney": FormatMoney,
+		"statusName":  StatusName,
+		"bankResult":  BankResultName,
+		"payment":     PaymentAccount,
+		"formatIBAN":  FormatIBAN,
+		"taxRate":     FormatTaxRate,
+		"taxClasses":  TaxClasses,
+		"groups":      MemberGroups,
+		"groupName":   GroupName,
 		"prefix":      GlobalPrefix,
+		"url":         GlobalUrl,
+		"imageUrl":    ImageUrl,
+		"thumbUrl":    ThumbUrl,
+		// Replaced per request by RenderTemplate
+		"csrfField": func() template.HTML { return "" },
 	}
 
 	TemplateCache = template.New("all").Funcs(funcs)
+	MailTemplateCache = texttemplate.New("mails").Funcs(texttemplate.FuncMap(funcs))
+	mailDir := filepath.Join(GlobalConfig.Templates, "mails") + string(filepath.Separator)
 
 	log.Println("Load templates from '" + GlobalConfig.Templates + "'")
 
@@ -84,7 +116,12 @@ func InitializeTemplates() error {
 			if !info.IsDir() && filepath.Base(path)[0:1] != "." {
 				log.Println("Load '" + path + "'")
 
-				_, err = TemplateCache.ParseFiles(path)
+				// Mails are plain text and must not be HTML escaped
+				if strings.HasPrefix(path, mailDir) {
+					_, err = MailTemplateCache.ParseFiles(path)
+				} else {
+					_, err = TemplateCache.ParseFiles(path)
+				}
 				if err != nil {
 					log.Println(err)
 				}
@@ -111,8 +148,9 @@ func IsGuest(member Member) bool {
 	return member.Id == 0
 }
 
-func IsAdmin(member Member) bool {
-	return member.Group == "admin"
+// Argument order allows {{ if .Member | can "products.edit" }}.
+func Can(perm string, member Member) bool {
+	return HasPermission(member, perm)
 }
 
 func FormatDate(unix int64) string {
@@ -123,6 +161,26 @@ func FormatMoney(cents uint64) string {
 	return fmt.Sprintf("%0.2f", float64(cents)/100.0)
 }
 
+func StatusName(status string) string {
+	if name, ok := OrderStatusNames[status]; ok {
+		return name
+	}
+	return "Unbekannt"
+}
+
 func GlobalPrefix() string {
 	return GlobalConfig.Location
 }
+
+// Absolute URL of the shop, for links in mails.
+func GlobalUrl() string {
+	return GlobalConfig.Url + GlobalConfig.Location
+}
+
+func ImageUrl(name string) string {
+	return GlobalConfig.Location + "/images/" + name
+}
+
+func ThumbUrl(name string) string {
+	return GlobalConfig.Location + "/images/" + ThumbnailName(name)
+}
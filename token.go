@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be granted. Requests authenticated by a token are
+// limited to the paths of its scopes and to what its member may do anyway.
+var TokenScopes = map[string]string{
+	"products:read":  "Artikel und Kategorien lesen",
+	"products:write": "Artikel anlegen, ändern und löschen",
+	"orders:read":    "Bestellungen lesen",
+	"orders:write":   "Bestellungen ändern",
+}
+
+// Path prefixes reachable with API tokens and the scope they belong to. GET
+// and HEAD requests need the ":read", all others the ":write" scope. Paths
+// with an empty scope are open to every token. Checkout and guest order
+// lookups below "/orders/" are excluded, see isCustomerRequest.
+var tokenPaths = []struct {
+	Prefix string
+	Scope  string
+}{
+	{APIPrefix + "session", ""},
+	{APIPrefix + "products", "products"},
+	{APIPrefix + "categories", "products"},
+	{APIPrefix + "variants", "products"},
+	{APIPrefix + "orders", "orders"},
+	{APIPrefix + "addresses", "orders"},
+	{APIPrefix + "coupons", "orders"},
+	{"/products/", "products"},
+	{"/categories/", "products"},
+	{"/variants/", "products"},
+	{"/orders/", "orders"},
+	{"/coupons/", "orders"},
+}
+
+// Checkout and claiming guest orders act for the member as a customer. Tokens
+// are for scripts managing the shop and can't do either, whatever their
+// scopes.
+func isCustomerRequest(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/orders/new") || strings.HasPrefix(r.URL.Path, "/orders/lookup/") {
+		return true
+	}
+	return r.Method == "POST" && strings.TrimSuffix(r.URL.Path, "/") == APIPrefix+"orders"
+}
+
+type APIToken struct {
+	Id       int64
+	Member   int64
+	Name     string
+	Token    string // SHA-256 of the token
+	Scopes   []string
+	Created  int64 // Unix time
+	LastUsed int64 // Unix time, 0 if never used
+}
+
+// Only the SHA-256 of a token is stored, so a leaked database does not allow
+// taking over accounts.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func APITokenFromRow(rows *sql.Rows) (APIToken, error) {
+	var tok APIToken
+	var scopes string
+
+	err := rows.Scan(&tok.Id, &tok.Member, &tok.Name, &tok.Token, &scopes, &tok.Created, &tok.LastUsed)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	tok.Scopes = strings.Fields(scopes)
+	return tok, nil
+}
+
+func (tok APIToken) HasScope(scope string) bool {
+	for _, s := range tok.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the token may be used for the request.
+func (tok APIToken) Allows(r *http.Request) bool {
+	if isCustomerRequest(r) {
+		return false
+	}
+
+	for _, p := range tokenPaths {
+		if !strings.HasPrefix(r.URL.Path, p.Prefix) {
+			continue
+		}
+
+		if p.Scope == "" {
+			return true
+		}
+
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return tok.HasScope(p.Scope + ":read")
+		}
+		return tok.HasScope(p.Scope + ":write")
+	}
+
+	return false
+}
+
+// Creates a token for the member and returns it together with the secret
+// that has to be presented as "Authorization: Bearer <secret>". The secret is
+// not stored and can't be shown again.
+func NewAPIToken(mem Member, name string, scopes []string, database *sql.DB) (APIToken, string, error) {
+	if name == "" {
+		return APIToken{}, "", NewStatusError(400, "Missing token name")
+	}
+
+	if len(scopes) == 0 {
+		return APIToken{}, "", NewStatusError(400, "No scopes given")
+	}
+
+	for _, s := range scopes {
+		if _, ok := TokenScopes[s]; !ok {
+			return APIToken{}, "", NewStatusError(400, "Unknown scope '%s'", s)
+		}
+	}
+
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	secret := hex.EncodeToString(buf)
+	tok := APIToken{0, mem.Id, name, HashToken(secret), scopes, time.Now().Unix(), 0}
+
+	res, err := database.Exec("INSERT INTO api_tokens VALUES ( NULL, ?, ?, ?, ?, ?, ? )", tok.Member, tok.Name, tok.Token, strings.Join(tok.Scopes, " "), tok.Created, tok.LastUsed)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	tok.Id, err = res.LastInsertId()
+	return tok, secret, err
+}
+
+// Looks up the token belonging to secret and records its use.
+func AuthenticateAPIToken(secret string, database *sql.DB) (APIToken, error) {
+	rows, err := database.Query("SELECT * FROM api_tokens WHERE token = ?", HashToken(secret))
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return APIToken{}, errors.New("No such token")
+	}
+
+	tok, err := APITokenFromRow(rows)
+	rows.Close()
+
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	tok.LastUsed = time.Now().Unix()
+	_, err = database.Exec("UPDATE api_tokens SET lastused = ? WHERE id = ?", tok.LastUsed, tok.Id)
+
+	return tok, err
+}
+
+func FetchAPIToken(id int64, database *sql.DB) (APIToken, error) {
+	rows, err := database.Query("SELECT * FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return APIToken{}, errors.New("No such token")
+	}
+
+	tok, err := APITokenFromRow(rows)
+	rows.Close()
+
+	return tok, err
+}
+
+// Tokens of the member, or of all members if memId is -1.
+func FetchAPITokens(memId int64, database *sql.DB) ([]APIToken, error) {
+	rows, err := database.Query("SELECT * FROM api_tokens WHERE member = ? OR ? = -1 ORDER BY member, id", memId, memId)
+	if err != nil {
+		return nil, err
+	}
+
+	toks := make([]APIToken, 0)
+	for rows.Next() {
+		tok, err := APITokenFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		toks = append(toks, tok)
+	}
+	rows.Close()
+
+	return toks, nil
+}
+
+type NamedAPIToken struct {
+	APIToken
+	Owner Member
+}
+
+func GetAPITokens(mem Member, secret string, w http.ResponseWriter, r *http.Request) {
+	memId := mem.Id
+	if HasPermission(mem, "tokens.manage") {
+		memId = -1
+	}
+
+	DatabaseMutex.Lock()
+	toks, err := FetchAPITokens(memId, Database)
+
+	named := make([]NamedAPIToken, 0)
+	for _, tok := range toks {
+		if err != nil {
+			break
+		}
+
+		var owner Member
+		owner, err = FetchMember(tok.Member, Database)
+		named = append(named, NamedAPIToken{tok, owner})
+	}
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch tokens: "+err.Error(), 500)
+		return
+	}
+
+	scopes := make([]string, 0)
+	for s := range TokenScopes {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	meta := struct {
+		Tokens       []NamedAPIToken
+		Scopes       []string
+		Descriptions map[string]string
+		Secret       string
+		Member       Member
+	}{
+		named,
+		scopes,
+		TokenScopes,
+		secret,
+		mem,
+	}
+
+	RenderTemplate(w, r, "tokens/list", "", mem, meta)
+}
+
+func PostNewAPIToken(mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	_, secret, err := NewAPIToken(mem, strings.TrimSpace(r.PostForm.Get("name")), r.PostForm["scopes"], Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to create token: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	// The secret is shown once and never again
+	GetAPITokens(mem, secret, w, r)
+}
+
+// Revokes the token. Members can revoke their own tokens, admins all of them.
+func DeleteAPIToken(tok APIToken, mem Member, w http.ResponseWriter, r *http.Request) {
+	if tok.Member != mem.Id && !HasPermission(mem, "tokens.manage") {
+		http.Error(w, "Token not found", 404)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	_, err := Database.Exec("DELETE FROM api_tokens WHERE id = ?", tok.Id)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to revoke token: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/tokens/", 301)
+}
+
+func HandleAPIToken(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleAPIToken() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if mem.Id == 0 {
+		http.Redirect(w, r, "/pages/login", 301)
+		return
+	}
+
+	meth := r.Method
+	if r.Method == "POST" {
+		err := r.ParseForm()
+
+		if err != nil {
+			http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+			return
+		}
+
+		meths, ok := r.PostForm["_method"]
+		if ok && len(meths) == 1 && len(meths[0]) > 0 {
+			meth = meths[0]
+		}
+	}
+
+	if r.URL.Path == "/tokens" || r.URL.Path == "/tokens/" {
+		if meth == "GET" {
+			GetAPITokens(mem, "", w, r)
+		} else if meth == "POST" {
+			PostNewAPIToken(mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		tokId, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/tokens/"), 10, 64)
+
+		if err != nil {
+			http.Error(w, "Token not found: "+err.Error(), 404)
+			return
+		}
+
+		DatabaseMutex.Lock()
+		tok, err := FetchAPIToken(tokId, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Token not found: "+err.Error(), 404)
+			return
+		}
+
+		if meth == "DELETE" {
+			DeleteAPIToken(tok, mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	}
+}
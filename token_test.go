@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		path   string
+		want   bool
+	}{
+		{[]string{"orders:read"}, "GET", "/api/v1/session", true},
+		{[]string{"orders:read"}, "GET", "/api/v1/orders", true},
+		{[]string{"orders:read"}, "GET", "/api/v1/orders/12", true},
+		{[]string{"orders:read"}, "PUT", "/api/v1/orders/12", false},
+		{[]string{"orders:write"}, "PUT", "/api/v1/orders/12", true},
+		{[]string{"orders:write"}, "DELETE", "/api/v1/orders/12", true},
+		{[]string{"orders:read"}, "GET", "/orders/12", true},
+		{[]string{"orders:read"}, "GET", "/orders/invoice/12", true},
+		{[]string{"orders:write"}, "POST", "/orders/12", true},
+		{[]string{"products:write"}, "POST", "/orders/12", false},
+		{[]string{"products:read"}, "GET", "/api/v1/products/3", true},
+		{[]string{"products:read"}, "PUT", "/api/v1/products/3", false},
+		{[]string{"products:write"}, "POST", "/api/v1/variants", true},
+		// Checkout and guest order claims aren't for tokens
+		{[]string{"orders:read", "orders:write"}, "POST", "/api/v1/orders", false},
+		{[]string{"orders:read", "orders:write"}, "POST", "/api/v1/orders/", false},
+		{[]string{"orders:read", "orders:write"}, "GET", "/orders/new", false},
+		{[]string{"orders:read", "orders:write"}, "POST", "/orders/new", false},
+		{[]string{"orders:read", "orders:write"}, "GET", "/orders/lookup/3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b", false},
+		{[]string{"orders:read", "orders:write"}, "POST", "/orders/lookup/3f2a6c1e-9b4d-4e8f-a1b2-0c9d8e7f6a5b", false},
+		// Not covered by any scope
+		{[]string{"orders:write", "products:write"}, "POST", "/api/v1/cart", false},
+		{[]string{"orders:write", "products:write"}, "PUT", "/api/v1/members/1", false},
+		{[]string{"orders:write", "products:write"}, "POST", "/tokens/", false},
+		{[]string{"orders:write", "products:write"}, "POST", "/bank/", false},
+	}
+
+	for _, tt := range tests {
+		tok := APIToken{Scopes: tt.scopes}
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := tok.Allows(r); got != tt.want {
+			t.Errorf("%v: %s %s allowed %v, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Version of a product, e.g. a size or colour, with its own stock. Products
+// with variants can only be put into carts by variant, the stock of the
+// product itself is unused then.
+type Variant struct {
+	Id       int64  `json:"id"`
+	Product  int64  `json:"product"`
+	Name     string `json:"name"` // E.g. "M, schwarz"
+	SKU      string `json:"sku"`
+	Price    uint64 `json:"price"`    // Overrides the prices of the product unless 0
+	Count    uint64 `json:"count"`    // In stock, including items reserved in carts
+	Reserved uint64 `json:"reserved"` // Reserved by active carts
+	// Prices for member groups, override those of the product
+	GroupPrices map[string]uint64 `json:"groupPrices"`
+}
+
+// Number of items that can still be put into a cart.
+func (v Variant) Available() uint64 {
+	if v.Reserved > v.Count {
+		return 0
+	}
+	return v.Count - v.Reserved
+}
+
+// Price of the variant of prod for members of the group. Unless the variant
+// has a price for the group, variants with their own price get the same
+// discount the group gets on the product, e.g. 25% off the XXL shirt if
+// members pay 15 instead of 20 EUR for the others.
+func (v Variant) PriceOf(prod Product, group string) uint64 {
+	if price, ok := v.GroupPrices[group]; ok {
+		return price
+	}
+	if v.Price == 0 {
+		return prod.PriceFor(group)
+	}
+	if prod.Price == 0 {
+		return v.Price
+	}
+	return divRound(v.Price*prod.PriceFor(group), prod.Price)
+}
+
+func VariantFromRow(rows *sql.Rows) (Variant, error) {
+	var v Variant
+
+	err := rows.Scan(&v.Id, &v.Product, &v.Name, &v.SKU, &v.Price, &v.Count)
+	return v, err
+}
+
+func FetchVariant(id int64, database *sql.DB) (Variant, error) {
+	rows, err := database.Query("SELECT * FROM variants WHERE id = ?", id)
+	if err != nil {
+		return Variant{}, err
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		return Variant{}, errors.New("No such variant")
+	}
+
+	v, err := VariantFromRow(rows)
+	rows.Close()
+
+	if err != nil {
+		return Variant{}, err
+	}
+
+	v.Reserved, err = ReservedCount(v.Product, v.Id, database)
+	if err != nil {
+		return Variant{}, err
+	}
+
+	v.GroupPrices, err = FetchVariantGroupPrices(v.Id, database)
+	return v, err
+}
+
+// Variants of the product in the order they were added.
+func FetchVariants(prodId int64, database *sql.DB) ([]Variant, error) {
+	rows, err := database.Query("SELECT * FROM variants WHERE product = ? ORDER BY id", prodId)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make([]Variant, 0)
+	for rows.Next() {
+		v, err := VariantFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		vars = append(vars, v)
+	}
+	rows.Close()
+
+	for i := range vars {
+		vars[i].Reserved, err = ReservedCount(prodId, vars[i].Id, database)
+		if err != nil {
+			return nil, err
+		}
+
+		vars[i].GroupPrices, err = FetchVariantGroupPrices(vars[i].Id, database)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vars, nil
+}
+
+func VariantFromForm(form url.Values) (Variant, error) {
+	var v Variant
+	var err error
+
+	v.Product, err = strconv.ParseInt(form.Get("product"), 10, 64)
+	if err != nil {
+		return Variant{}, fmt.Errorf("Invalid product")
+	}
+
+	v.Name = strings.TrimSpace(form.Get("name"))
+	v.SKU = strings.TrimSpace(form.Get("sku"))
+
+	if price := form.Get("price"); price != "" {
+		v.Price, err = strconv.ParseUint(price, 10, 64)
+		if err != nil {
+			return Variant{}, fmt.Errorf("Invalid price")
+		}
+	}
+
+	v.Count, err = strconv.ParseUint(form.Get("count"), 10, 64)
+	if err != nil {
+		return Variant{}, fmt.Errorf("Invalid count")
+	}
+
+	v.GroupPrices, err = GroupPricesFromForm(form)
+	if err != nil {
+		return Variant{}, err
+	}
+
+	return v, nil
+}
+
+// Fails if the variant has no name, its product does not exist or another
+// variant has the same SKU.
+func CheckVariant(v Variant, database *sql.DB) error {
+	if v.Name == "" {
+		return NewStatusError(400, "Missing or empty name")
+	}
+
+	_, err := FetchProduct(v.Product, database)
+	if err != nil {
+		return NewStatusError(400, "No such product")
+	}
+
+	if v.SKU != "" {
+		var cnt int64
+		err = database.QueryRow("SELECT COUNT(*) FROM variants WHERE sku = ? AND id <> ?", v.SKU, v.Id).Scan(&cnt)
+		if err != nil {
+			return err
+		}
+		if cnt > 0 {
+			return NewStatusError(400, "SKU '%s' exists already", v.SKU)
+		}
+	}
+
+	return CheckGroupPrices(v.GroupPrices)
+}
+
+func InsertVariant(v Variant, database *sql.DB) (Variant, error) {
+	res, err := database.Exec("INSERT INTO variants VALUES ( NULL, ?, ?, ?, ?, ? )", v.Product, v.Name, v.SKU, v.Price, v.Count)
+	if err != nil {
+		return Variant{}, err
+	}
+
+	v.Id, err = res.LastInsertId()
+	if err != nil {
+		return Variant{}, err
+	}
+
+	return v, SaveVariantGroupPrices(v, database)
+}
+
+// Updates everything but the product the variant belongs to.
+func UpdateVariant(v Variant, database *sql.DB) error {
+	_, err := database.Exec("UPDATE variants SET name = ?, sku = ?, price = ?, count = ? WHERE id = ?", v.Name, v.SKU, v.Price, v.Count, v.Id)
+	if err != nil {
+		return err
+	}
+
+	return SaveVariantGroupPrices(v, database)
+}
+
+// Removes the variant and takes it out of all carts. Orders keep their copy of
+// name and SKU.
+func RemoveVariant(v Variant, database *sql.DB) error {
+	_, err := database.Exec("DELETE FROM carts WHERE variant = ?", v.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM variant_prices WHERE variant = ?", v.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("DELETE FROM variants WHERE id = ?", v.Id)
+	return err
+}
+
+func PostNewVariant(mem Member, w http.ResponseWriter, r *http.Request) {
+	v, err := VariantFromForm(r.PostForm)
+	if err != nil {
+		http.Error(w, "Failed to create variant: "+err.Error(), 400)
+		return
+	}
+
+	DatabaseMutex.Lock()
+	err = CheckVariant(v, Database)
+	if err == nil {
+		_, err = InsertVariant(v, Database)
+	}
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to create variant: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/products/"+strconv.FormatInt(v.Product, 10), 301)
+}
+
+func PutVariant(v Variant, mem Member, w http.ResponseWriter, r *http.Request) {
+	r.PostForm.Set("product", strconv.FormatInt(v.Product, 10))
+
+	new_v, err := VariantFromForm(r.PostForm)
+	if err != nil {
+		http.Error(w, "Failed to update variant: "+err.Error(), 400)
+		return
+	}
+	new_v.Id = v.Id
+
+	DatabaseMutex.Lock()
+	err = CheckVariant(new_v, Database)
+	if err == nil {
+		err = UpdateVariant(new_v, Database)
+	}
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to update variant: "+err.Error(), ErrorStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/products/"+strconv.FormatInt(v.Product, 10), 301)
+}
+
+func DeleteVariant(v Variant, mem Member, w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	err := RemoveVariant(v, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to delete variant: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/products/"+strconv.FormatInt(v.Product, 10), 301)
+}
+
+func HandleVariant(w http.ResponseWriter, r *http.Request) {
+	DatabaseMutex.Lock()
+	sess := FetchOrCreateSession(w, r, Database)
+	mem, err := FetchMember(sess.Member, Database)
+	DatabaseMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Failed to fetch member: "+err.Error(), 500)
+		return
+	}
+
+	fmt.Println("HandleVariant() Path = '" + r.URL.Path + "', Method = " + r.Method)
+
+	if !HasPermission(mem, "products.edit") {
+		http.Error(w, "Insufficient permissions", 403)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", 405)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form data: "+err.Error(), 500)
+		return
+	}
+
+	meth := "POST"
+	meths, ok := r.PostForm["_method"]
+	if ok && len(meths) == 1 && len(meths[0]) > 0 {
+		meth = meths[0]
+	}
+
+	if r.URL.Path == "/variants" || r.URL.Path == "/variants/" {
+		if meth == "POST" {
+			PostNewVariant(mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	} else {
+		varId, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/variants/"), 10, 64)
+		if err != nil {
+			http.Error(w, "Variant not found: "+err.Error(), 404)
+			return
+		}
+
+		DatabaseMutex.Lock()
+		v, err := FetchVariant(varId, Database)
+		DatabaseMutex.Unlock()
+
+		if err != nil {
+			http.Error(w, "Variant not found: "+err.Error(), 404)
+			return
+		}
+
+		if meth == "PUT" {
+			PutVariant(v, mem, w, r)
+		} else if meth == "DELETE" {
+			DeleteVariant(v, mem, w, r)
+		} else {
+			http.Error(w, "Method not supported", 405)
+		}
+	}
+}
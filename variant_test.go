@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestVariantPriceOf(t *testing.T) {
+	// Labor members pay 15 instead of 20 EUR
+	shirt := Product{Price: 2000, GroupPrices: map[string]uint64{"member": 1500}}
+
+	tests := []struct {
+		name    string
+		prod    Product
+		variant Variant
+		group   string
+		want    uint64
+	}{
+		{"product price", shirt, Variant{}, "customer", 2000},
+		{"product group price", shirt, Variant{}, "member", 1500},
+		{"own price", shirt, Variant{Price: 2400}, "customer", 2400},
+		{"own price bought by member", shirt, Variant{Price: 2400}, "member", 1800},
+		{"own price bought by member, rounded", shirt, Variant{Price: 2210}, "member", 1658},
+		{"own group price", shirt, Variant{Price: 2400, GroupPrices: map[string]uint64{"member": 1900}}, "member", 1900},
+		{"own group price of another group", shirt, Variant{Price: 2400, GroupPrices: map[string]uint64{"admin": 0}}, "member", 1800},
+		{"own group price without own price", shirt, Variant{GroupPrices: map[string]uint64{"member": 1200}}, "member", 1200},
+		{"free group price", shirt, Variant{Price: 2400, GroupPrices: map[string]uint64{"member": 0}}, "member", 0},
+		{"free product", Product{}, Variant{Price: 500}, "member", 500},
+		{"product without group prices", Product{Price: 2000}, Variant{Price: 2400}, "member", 2400},
+	}
+
+	for _, tt := range tests {
+		if got := tt.variant.PriceOf(tt.prod, tt.group); got != tt.want {
+			t.Errorf("%s: PriceOf() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}